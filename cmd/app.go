@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"github.com/fpawel/procmq"
 	"github.com/fpawel/ufo82/internal/hardware"
 	"github.com/fpawel/ufo82/internal/ufo82"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -21,25 +27,77 @@ const (
 	PeerPlaceChecked
 	PeerStartHardware
 	PeerStopHardware
+	PeerHardwareLink
+	PeerHardwareNetAddress
+	PeerHardwareComm
+	PeerHardwarePlaces
+	PeerHardwareBlockRead
+	PeerHardwareCyclePeriod
+	PeerHardwareTrafficLog
+	PeerHardwareScan
+	PeerHardwareWrite
+	PeerCalibrateZero
+	PeerCalibrateSpan
+	PeerEvaluateParty
+	PeerSensitivityLimits
+	PeerHardwareStabilization
+	PeerHardwareStatusBits
+	PeerMsgSensitivityBuckets
+	PeerMsgSensitivitiesPage
+	PeerMsgProductHistory
+	PeerPartyInfo
 )
 
 type app struct {
-	pipe     procmq.ProcessMQ
-	hardware hardware.Provider
-	peer     syncSender
-	db       ufo82.DB
+	pipe       procmq.ProcessMQ
+	hardware   hardware.Provider
+	bus        *hardware.Bus
+	peer       syncSender
+	db         ufo82.DB
+	dbWriter   *ufo82.Writer
+	calibrator *calibrator
+	// peerForwarded закрывается после передачи peer всех событий оборудования
+	peerForwarded chan struct{}
 }
 
+// размер буфера событий оборудования подписчика
+const hardwareEventsBufferSize = 10000
+
+// наибольшее время ожидания остановки опроса оборудования
+const stopHardwareTimeout = 5 * time.Second
+
+// наибольшее время выполнения запроса к базе данных
+const dbTimeout = 10 * time.Second
+
 func newApp(writerPipeConn net.Conn) *app {
 	x := new(app)
 	x.db = ufo82.MustConnectDB(appFolderFileName("products.db"))
-	x.peer = newSyncSender(writerPipeConn, x.db)
-	x.hardware = hardware.NewProvider(x.peer, appFolderFileName("hardware.json"))
+	x.bus = hardware.NewBus()
+	x.dbWriter = ufo82.NewWriter(x.db, x.bus)
+	x.peer = newSyncSender(writerPipeConn, x.db, func() {
+		x.dbWriter.PartyChanged()
+		x.calibrator.PartyChanged()
+	}, x.dbWriter.Flush)
+
+	x.peerForwarded = make(chan struct{})
+	peerEvents := x.bus.Subscribe("pipe", hardwareEventsBufferSize)
+	go func() {
+		peerEvents.Forward(x.peer)
+		close(x.peerForwarded)
+	}()
+	go logHardware(x.bus.Subscribe("log", 100))
+
+	x.hardware = hardware.NewProvider(x.bus, appFolderFileName("hardware.json"))
+	x.calibrator = newCalibrator(x.db, x.hardware, x.peer, x.bus.Subscribe("calibration", hardwareEventsBufferSize))
 	return x
 }
 
 func (x *app) Close() error {
 	fmt.Println("CLOSE HARDWARE:", x.hardware.Close())
+	x.bus.Close()
+	x.dbWriter.Wait()
+	x.calibrator.Wait()
+	<-x.peerForwarded
 	fmt.Println("CLOSE PEER:", x.peer.Close())
 	fmt.Println("CLOSE DATABASE:", x.db.Close())
 	return nil
@@ -72,7 +130,7 @@ func (x *app) Run(readerPipeConn net.Conn) error {
 			if err != nil {
 				return err
 			}
-			x.peer.SendDays(ufo82.YearMonth{int(year), int(month)})
+			x.peer.SendDays(ufo82.YearMonth{Year: int(year), Month: int(month)})
 
 		case PeerMsgPartiesOfYearMonthDay:
 			year, err := pipe.ReadUInt32()
@@ -100,6 +158,79 @@ func (x *app) Run(readerPipeConn net.Conn) error {
 				return err
 			}
 			x.peer.SendSensitivitiesOfProduct(ufo82.ProductID(productID))
+		case PeerMsgSensitivityBuckets:
+			// идентификатор прибора, начало и конец диапазона времени в миллисекундах unix
+			// (0 - от первой или до последней чувствительности), количество интервалов
+			var v [3]uint64
+			for i := range v {
+				if v[i], err = pipe.ReadUInt64(); err != nil {
+					return err
+				}
+			}
+			count, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.peer.SendSensitivityBuckets(sensitivityBucketsRequest{
+				productID: ufo82.ProductID(v[0]),
+				from:      unixMillisTime(v[1]),
+				to:        unixMillisTime(v[2]),
+				count:     int(count),
+			})
+
+		case PeerMsgSensitivitiesPage:
+			// идентификатор прибора, начало и конец диапазона времени в миллисекундах unix
+			// (0 - без ограничения), курсор, размер страницы и направление: 1 - от новых к старым
+			var v [4]uint64
+			for i := range v {
+				if v[i], err = pipe.ReadUInt64(); err != nil {
+					return err
+				}
+			}
+			limit, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			backward, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.peer.SendSensitivitiesPage(ufo82.SensitivitiesQuery{
+				ProductID: ufo82.ProductID(v[0]),
+				From:      unixMillisTime(v[1]),
+				To:        unixMillisTime(v[2]),
+				Cursor:    int64(v[3]),
+				Limit:     int(limit),
+				Backward:  backward != 0,
+			})
+
+		case PeerMsgProductHistory:
+			// диапазон заводских номеров, для одного номера начало и конец совпадают
+			serialMin, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			serialMax, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.peer.SendProductHistory(serialRange{int64(serialMin), int64(serialMax)})
+
+		case PeerPartyInfo:
+			partyID, err := pipe.ReadUInt64()
+			if err != nil {
+				return err
+			}
+			info, errValue, err := readPartyInfo(pipe)
+			if err != nil {
+				return err
+			}
+			if errValue != nil {
+				x.peer.SendInfoMessage(InfoMessage{errValue.Error(), "clRed"})
+				continue
+			}
+			x.peer.SetPartyInfo(ufo82.PartyID(partyID), info)
+
 		case PeerCurrentProductSerial:
 			order, err := pipe.ReadUInt32()
 			if err != nil {
@@ -135,10 +266,170 @@ func (x *app) Run(readerPipeConn net.Conn) error {
 			}
 			x.hardware.SetChecked(int(order), checked != 0)
 
+		case PeerHardwareLink:
+			link, err := pipe.ReadString()
+			if err != nil {
+				return err
+			}
+			x.hardware.SetLink(hardware.Link(link))
+
+		case PeerHardwareNetAddress:
+			host, err := pipe.ReadString()
+			if err != nil {
+				return err
+			}
+			port, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.hardware.SetNetAddress(host, int(port))
+
+		case PeerHardwareComm:
+			comm, err := readHardwareComm(pipe)
+			if err != nil {
+				return err
+			}
+			x.hardware.SetComm(comm)
+
+		case PeerHardwarePlaces:
+			places, errValue, err := readHardwarePlaces(pipe)
+			if err != nil {
+				return err
+			}
+			if errValue != nil {
+				x.peer.SendInfoMessage(InfoMessage{errValue.Error(), "clRed"})
+				continue
+			}
+			x.hardware.SetPlaces(places)
+
+		case PeerHardwareBlockRead:
+			blockRead, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.hardware.SetBlockRead(blockRead != 0)
+
+		case PeerHardwareCyclePeriod:
+			period, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.hardware.SetCyclePeriod(int(period))
+
+		case PeerHardwareTrafficLog:
+			enabled, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.hardware.SetTrafficLog(enabled != 0)
+
+		case PeerHardwareScan:
+			addrMin, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			addrMax, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			x.hardware.Scan(int(addrMin), int(addrMax))
+
+		case PeerHardwareWrite:
+			place, offset, values, errValue, err := readHardwareWrite(pipe)
+			if err != nil {
+				return err
+			}
+			if errValue != nil {
+				x.peer.SendInfoMessage(InfoMessage{errValue.Error(), "clRed"})
+				continue
+			}
+			x.hardware.Write(place, offset, values)
+
+		case PeerCalibrateZero:
+			x.calibrator.Zero()
+
+		case PeerCalibrateSpan:
+			// концентрация газа строкой, чтобы не зависеть от представления дробных чисел
+			str, err := pipe.ReadString()
+			if err != nil {
+				return err
+			}
+			concentration, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				x.peer.SendInfoMessage(InfoMessage{fmt.Sprintf("калибровка: недопустимая концентрация газа: %q", str), "clRed"})
+				continue
+			}
+			x.calibrator.Span(concentration)
+
+		case PeerEvaluateParty:
+			partyID, err := pipe.ReadUInt64()
+			if err != nil {
+				return err
+			}
+			x.peer.EvaluateParty(ufo82.PartyID(partyID))
+
+		case PeerSensitivityLimits:
+			// нижний и верхний пределы строками, как концентрация газа калибровки
+			var limits [2]float64
+			for i := range limits {
+				str, err := pipe.ReadString()
+				if err != nil {
+					return err
+				}
+				if limits[i], err = strconv.ParseFloat(str, 64); err != nil {
+					limits[i] = math.NaN()
+				}
+			}
+			if math.IsNaN(limits[0]) || math.IsNaN(limits[1]) {
+				x.peer.SendInfoMessage(InfoMessage{"недопустимые пределы чувствительности", "clRed"})
+				continue
+			}
+			x.peer.SetSensitivityLimits(ufo82.Limits{Min: limits[0], Max: limits[1]})
+
+		case PeerHardwareStabilization:
+			// окно в миллисекундах, дрейф и шум строками
+			window, err := pipe.ReadUInt32()
+			if err != nil {
+				return err
+			}
+			var v [2]float64
+			for i := range v {
+				str, err := pipe.ReadString()
+				if err != nil {
+					return err
+				}
+				if v[i], err = strconv.ParseFloat(str, 64); err != nil {
+					v[i] = math.NaN()
+				}
+			}
+			if math.IsNaN(v[0]) || math.IsNaN(v[1]) {
+				x.peer.SendInfoMessage(InfoMessage{"недопустимые дрейф или шум установления", "clRed"})
+				continue
+			}
+			x.hardware.SetStabilization(hardware.Stabilization{Window: int(window), MaxDrift: v[0], MaxNoise: v[1]})
+
+		case PeerHardwareStatusBits:
+			bits, errValue, err := readHardwareStatusBits(pipe)
+			if err != nil {
+				return err
+			}
+			if errValue != nil {
+				x.peer.SendInfoMessage(InfoMessage{errValue.Error(), "clRed"})
+				continue
+			}
+			x.hardware.SetStatusBits(bits)
+
 		case PeerStartHardware:
-			x.hardware.Start()
+			if _, err := x.hardware.Start(context.Background()); err != nil {
+				x.peer.SendInfoMessage(InfoMessage{err.Error(), "clRed"})
+			}
 		case PeerStopHardware:
-			x.hardware.Stop()
+			ctx, cancel := context.WithTimeout(context.Background(), stopHardwareTimeout)
+			err := x.hardware.Stop(ctx)
+			cancel()
+			if err != nil {
+				fmt.Println("STOP HARDWARE:", err)
+			}
 
 		default:
 			panic(fmt.Errorf("unknown message: %d", cmd))
@@ -146,3 +437,198 @@ func (x *app) Run(readerPipeConn net.Conn) error {
 	}
 
 }
+
+func readHardwareComm(pipe procmq.Conn) (comm hardware.Comm, err error) {
+	var v uint32
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.Baud = int(v)
+	if comm.Parity, err = pipe.ReadString(); err != nil {
+		return
+	}
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.StopBits = int(v)
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.ReadTimeout = int(v)
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.ReadByteTimeout = int(v)
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.MaxAttemptsRead = int(v)
+	if v, err = pipe.ReadUInt32(); err != nil {
+		return
+	}
+	comm.RequestDelay = int(v)
+	return
+}
+
+// readHardwarePlaces считывает места стенда. errValue - недопустимое количество мест: места
+// всё равно считываются, чтобы не нарушить разбор следующих сообщений канала
+func readHardwarePlaces(pipe procmq.Conn) (places []hardware.Place, errValue, err error) {
+	count, err := pipe.ReadUInt32()
+	if err != nil {
+		return nil, nil, err
+	}
+	if count > hardware.MaxPlaces {
+		errValue = fmt.Errorf("количество мест стенда больше %d: %d", hardware.MaxPlaces, count)
+	} else {
+		places = make([]hardware.Place, 0, count)
+	}
+	for i := uint32(0); i < count; i++ {
+		place, err := readHardwarePlace(pipe)
+		if err != nil {
+			return nil, nil, err
+		}
+		if errValue == nil {
+			places = append(places, place)
+		}
+	}
+	return places, errValue, nil
+}
+
+// readHardwareWrite считывает место, смещение регистра в блоке места, количество и значения
+// регистров для записи. errValue - недопустимое количество регистров: значения всё равно
+// считываются, чтобы не нарушить разбор следующих сообщений канала
+func readHardwareWrite(pipe procmq.Conn) (place int, offset uint16, values []uint16, errValue, err error) {
+	var v [3]uint32
+	for i := range v {
+		if v[i], err = pipe.ReadUInt32(); err != nil {
+			return
+		}
+	}
+	if v[2] > hardware.PlaceRegisters {
+		errValue = fmt.Errorf("количество регистров записи больше %d: %d", hardware.PlaceRegisters, v[2])
+	} else {
+		values = make([]uint16, 0, v[2])
+	}
+	for i := uint32(0); i < v[2]; i++ {
+		value, err := pipe.ReadUInt32()
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+		if errValue == nil {
+			values = append(values, uint16(value))
+		}
+	}
+	return int(v[0]), uint16(v[1]), values, errValue, nil
+}
+
+func readHardwarePlace(pipe procmq.Conn) (place hardware.Place, err error) {
+	checked, err := pipe.ReadUInt32()
+	if err != nil {
+		return
+	}
+	addr, err := pipe.ReadUInt32()
+	if err != nil {
+		return
+	}
+	register, err := pipe.ReadUInt32()
+	if err != nil {
+		return
+	}
+	interval, err := pipe.ReadUInt32()
+	if err != nil {
+		return
+	}
+	// пределы показания строками, недопустимые значения отклоняются при проверке мест
+	var v [2]float64
+	for j := range v {
+		str, err := pipe.ReadString()
+		if err != nil {
+			return place, err
+		}
+		if v[j], err = strconv.ParseFloat(str, 64); err != nil {
+			v[j] = math.NaN()
+		}
+	}
+	return hardware.Place{
+		Checked:  checked != 0,
+		Addr:     byte(addr),
+		Register: uint16(register),
+		Interval: int(interval),
+		ValueMin: v[0],
+		ValueMax: v[1],
+	}, nil
+}
+
+// readHardwareStatusBits считывает описания бит статуса. errValue - недопустимое количество бит:
+// описания всё равно считываются, чтобы не нарушить разбор следующих сообщений канала
+func readHardwareStatusBits(pipe procmq.Conn) (bits []hardware.StatusBit, errValue, err error) {
+	count, err := pipe.ReadUInt32()
+	if err != nil {
+		return nil, nil, err
+	}
+	if count > hardware.StatusBits {
+		errValue = fmt.Errorf("количество бит статуса больше %d: %d", hardware.StatusBits, count)
+	} else {
+		bits = make([]hardware.StatusBit, 0, count)
+	}
+	for i := uint32(0); i < count; i++ {
+		bit, err := pipe.ReadUInt32()
+		if err != nil {
+			return nil, nil, err
+		}
+		name, err := pipe.ReadString()
+		if err != nil {
+			return nil, nil, err
+		}
+		fault, err := pipe.ReadUInt32()
+		if err != nil {
+			return nil, nil, err
+		}
+		if errValue == nil {
+			bits = append(bits, hardware.StatusBit{Bit: uint(bit), Name: name, Fault: fault != 0})
+		}
+	}
+	return bits, errValue, nil
+}
+
+// unixMillisTime возвращает время по миллисекундам unix, нулевое время для 0
+func unixMillisTime(ms uint64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// readPartyInfo считывает сведения о партии: название, оператора, тип приборов, номер заказа,
+// примечания и условия окружающей среды строками, пустая строка - не измерялось. errValue -
+// ошибка разбора условий окружающей среды, err - ошибка канала
+func readPartyInfo(pipe procmq.Conn) (info ufo82.PartyInfo, errValue, err error) {
+	for _, p := range []*string{&info.Name, &info.Operator, &info.ProductType, &info.BatchNumber, &info.Notes} {
+		if *p, err = pipe.ReadString(); err != nil {
+			return
+		}
+	}
+	for _, v := range []struct {
+		name string
+		p    *sql.NullFloat64
+	}{
+		{"температура", &info.Temperature},
+		{"влажность", &info.Humidity},
+		{"давление", &info.Pressure},
+	} {
+		var str string
+		if str, err = pipe.ReadString(); err != nil {
+			return
+		}
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		f, errParse := strconv.ParseFloat(str, 64)
+		if errParse != nil && errValue == nil {
+			errValue = fmt.Errorf("сведения о партии: недопустимое значение %s: %q", v.name, str)
+		}
+		*v.p = sql.NullFloat64{Float64: f, Valid: errParse == nil}
+	}
+	return
+}
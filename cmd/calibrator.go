@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fpawel/ufo82/internal/hardware"
+	"github.com/fpawel/ufo82/internal/ufo82"
+	"time"
+)
+
+// calibrationSamples - количество показаний места, усредняемых в точке калибровки
+const calibrationSamples = 5
+
+// calibrationMinTimeout - наименьшее время сбора показаний в точке калибровки. Оно
+// увеличивается для долгих периода и интервалов опроса
+const calibrationMinTimeout = 30 * time.Second
+
+type calibrationPoint int
+
+const (
+	calibrationZero calibrationPoint = iota
+	calibrationSpan
+)
+
+type calibrationCommand struct {
+	point calibrationPoint
+	// concentration - концентрация газа в точке calibrationSpan
+	concentration float64
+}
+
+// calibrationResult - результат калибровки места в точке point: усреднённое показание value
+// и, для calibrationSpan, вычисленные коэффициенты
+type calibrationResult struct {
+	pin         int
+	point       calibrationPoint
+	value       float64
+	calibration hardware.Calibration
+	err         error
+}
+
+// calibrator калибрует выбранные места стенда по нулевому газу и газу известной концентрации:
+// усредняет исходные показания мест, вычисляет коэффициенты, сохраняет их в базу данных для
+// приборов текущей партии и передаёт оборудованию для пересчёта последующих показаний
+type calibrator struct {
+	db           ufo82.DB
+	hardware     hardware.Provider
+	peer         syncSender
+	sub          *hardware.Subscription
+	commands     chan calibrationCommand
+	partyChanged chan struct{}
+	done         chan struct{}
+}
+
+// calibrationCapture - сбор показаний мест в точке калибровки до deadline
+type calibrationCapture struct {
+	calibrationCommand
+	samples  map[int][]float64
+	deadline *time.Timer
+}
+
+func newCalibrator(db ufo82.DB, provider hardware.Provider, peer syncSender, sub *hardware.Subscription) *calibrator {
+	x := &calibrator{
+		db:           db,
+		hardware:     provider,
+		peer:         peer,
+		sub:          sub,
+		commands:     make(chan calibrationCommand),
+		partyChanged: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// Zero начинает сбор показаний выбранных мест на нулевом газе
+func (x *calibrator) Zero() {
+	x.commands <- calibrationCommand{point: calibrationZero}
+}
+
+// Span начинает сбор показаний выбранных мест на газе с концентрацией concentration
+// и вычисление коэффициентов
+func (x *calibrator) Span(concentration float64) {
+	x.commands <- calibrationCommand{calibrationSpan, concentration}
+}
+
+// PartyChanged сообщает об изменении состава текущей партии
+func (x *calibrator) PartyChanged() {
+	select {
+	case x.partyChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Wait ожидает завершения после закрытия подписки
+func (x *calibrator) Wait() {
+	<-x.done
+}
+
+func (x *calibrator) run() {
+	defer close(x.done)
+	products := x.lastPartyProducts()
+	x.applyCalibrations(products)
+
+	// показания мест на нулевом газе
+	zeros := make(map[int]float64)
+	var capture *calibrationCapture
+	stopCapture := func() {
+		if capture != nil {
+			capture.deadline.Stop()
+			capture = nil
+		}
+	}
+	defer stopCapture()
+
+	for {
+		// nil, пока нет сбора показаний
+		var deadline <-chan time.Time
+		if capture != nil {
+			deadline = capture.deadline.C
+		}
+		select {
+		case <-x.partyChanged:
+			products = x.lastPartyProducts()
+			x.applyCalibrations(products)
+			zeros = make(map[int]float64)
+			stopCapture()
+
+		case c := <-x.commands:
+			stopCapture()
+			// выбранность мест берётся из текущего конфига оборудования
+			cfg := x.hardware.Config()
+			samples := make(map[int][]float64)
+			for pin, p := range cfg.Places {
+				if _, f := productOfPlace(products, pin); f && p.Checked {
+					samples[pin] = nil
+				}
+			}
+			if len(samples) == 0 {
+				x.peer.SendInfoMessage(InfoMessage{"калибровка: не выбраны места с приборами", "clRed"})
+				continue
+			}
+			capture = &calibrationCapture{c, samples, time.NewTimer(calibrationTimeout(cfg))}
+
+		case <-deadline:
+			x.finish(capture, products, zeros)
+			capture = nil
+
+		case e, ok := <-x.sub.C:
+			if !ok {
+				return
+			}
+			switch e := e.(type) {
+			case hardware.EventReading:
+				if capture == nil || e.Error != nil {
+					continue
+				}
+				samples, f := capture.samples[e.Pin]
+				if !f || len(samples) == calibrationSamples {
+					continue
+				}
+				capture.samples[e.Pin] = append(samples, float64(e.Raw))
+				if capture.complete() {
+					x.finish(capture, products, zeros)
+					stopCapture()
+				}
+			}
+		}
+	}
+}
+
+func (x *calibrationCapture) complete() bool {
+	for _, samples := range x.samples {
+		if len(samples) < calibrationSamples {
+			return false
+		}
+	}
+	return true
+}
+
+// calibrationTimeout возвращает время сбора показаний выбранных мест cfg в точке калибровки
+func calibrationTimeout(cfg hardware.Config) time.Duration {
+	period := cfg.CyclePeriod
+	for _, p := range cfg.Places {
+		if p.Checked && p.Interval > period {
+			period = p.Interval
+		}
+	}
+	// вдвое больше времени, чем нужно на calibrationSamples циклов опроса
+	if d := 2 * calibrationSamples * time.Duration(period) * time.Millisecond; d > calibrationMinTimeout {
+		return d
+	}
+	return calibrationMinTimeout
+}
+
+// finish вычисляет результат калибровки мест по собранным показаниям. Места, для которых
+// до истечения времени сбора не получено calibrationSamples показаний, не калибруются
+func (x *calibrator) finish(capture *calibrationCapture, products []ufo82.Product, zeros map[int]float64) {
+	for pin, samples := range capture.samples {
+		r := calibrationResult{pin: pin, point: capture.point}
+		if len(samples) < calibrationSamples {
+			r.err = fmt.Errorf("получено показаний %d из %d", len(samples), calibrationSamples)
+			if capture.point == calibrationZero {
+				delete(zeros, pin)
+			}
+			x.peer.HardwareCalibration(r)
+			continue
+		}
+		r.value = mean(samples)
+		if capture.point == calibrationZero {
+			zeros[pin] = r.value
+			x.peer.HardwareCalibration(r)
+			continue
+		}
+		zero, f := zeros[pin]
+		if !f {
+			r.err = errors.New("нет показания на нулевом газе")
+		} else {
+			r.calibration, r.err = hardware.NewCalibration(zero, r.value, capture.concentration)
+		}
+		if r.err == nil {
+			product, _ := productOfPlace(products, pin)
+			ctx, cancel := dbContext()
+			r.err = x.db.SaveCalibration(ctx, ufo82.Calibration{
+				ProductID:         product.ProductID,
+				ZeroValue:         zero,
+				SpanValue:         r.value,
+				SpanConcentration: capture.concentration,
+				Offset:            r.calibration.Offset,
+				Gain:              r.calibration.Gain,
+				CalibratedAt:      time.Now(),
+			})
+			cancel()
+		}
+		x.peer.HardwareCalibration(r)
+	}
+	if capture.point == calibrationSpan {
+		x.applyCalibrations(products)
+	}
+}
+
+// applyCalibrations передаёт оборудованию коэффициенты калибровки приборов текущей партии
+func (x *calibrator) applyCalibrations(products []ufo82.Product) {
+	if len(products) == 0 {
+		x.hardware.SetCalibrations(nil)
+		return
+	}
+	ctx, cancel := dbContext()
+	calibrations, err := x.db.GetPartyCalibrations(ctx, products[0].PartyID)
+	cancel()
+	if err != nil {
+		x.dbFailed(err)
+		return
+	}
+	byProduct := make(map[ufo82.ProductID]ufo82.Calibration)
+	for _, c := range calibrations {
+		byProduct[c.ProductID] = c
+	}
+	m := make(map[int]hardware.Calibration)
+	for _, p := range products {
+		if c, f := byProduct[p.ProductID]; f {
+			m[int(p.Order)] = hardware.Calibration{Offset: c.Offset, Gain: c.Gain}
+		}
+	}
+	x.hardware.SetCalibrations(m)
+}
+
+// lastPartyProducts возвращает приборы текущей партии
+func (x *calibrator) lastPartyProducts() []ufo82.Product {
+	ctx, cancel := dbContext()
+	defer cancel()
+	products, err := x.db.GetLastPartyProducts(ctx)
+	x.dbFailed(err)
+	return products
+}
+
+func (x *calibrator) dbFailed(err error) {
+	if err != nil {
+		fmt.Println("калибровка: база данных:", err)
+		x.peer.SendInfoMessage(InfoMessage{"калибровка: база данных: " + err.Error(), "clRed"})
+	}
+}
+
+func productOfPlace(products []ufo82.Product, pin int) (ufo82.Product, bool) {
+	for _, p := range products {
+		if p.Order == int64(pin) {
+			return p, true
+		}
+	}
+	return ufo82.Product{}, false
+}
+
+func mean(xs []float64) (r float64) {
+	for _, x := range xs {
+		r += x
+	}
+	return r / float64(len(xs))
+}
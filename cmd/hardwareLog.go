@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fpawel/ufo82/internal/hardware"
+)
+
+// logHardware выводит в консоль события подключения оборудования до закрытия подписки
+func logHardware(sub *hardware.Subscription) {
+	for e := range sub.C {
+		switch e := e.(type) {
+		case hardware.EventConnected:
+			fmt.Println("HARDWARE: connected")
+		case hardware.EventDisconnected:
+			fmt.Println("HARDWARE: disconnected")
+		case hardware.EventConnectionError:
+			fmt.Println("HARDWARE:", e.Text)
+		case hardware.EventReconnect:
+			fmt.Println("HARDWARE: reconnect", e.Attempt, e.Delay)
+		case hardware.EventReconnected:
+			fmt.Println("HARDWARE: reconnected")
+		case hardware.EventProbe:
+			for _, r := range e.Results {
+				fmt.Println("HARDWARE: probe", r.Port, r.Addrs)
+			}
+		}
+	}
+}
@@ -4,11 +4,17 @@ import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/natefinch/npipe.v2"
+	"os"
 	"os/exec"
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "modbus" {
+		runModbusCommand()
+		return
+	}
+
 	// сделать cmd сервер
 	pipeReadListener, err := npipe.Listen(`\\.\pipe\$UFO82_FROM_PEER_TO_MASTER$`)
 	if err != nil {
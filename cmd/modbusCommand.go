@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/fpawel/ufo82/internal/hardware"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// modbusCommand - диагностика стенда без запуска приложения: чтение и запись регистров устройства
+// через канал связи из конфига оборудования.
+//
+//	ufo82 modbus -addr 17 -reg 4 -count 2 -format float -repeat 1s
+//	ufo82 modbus -addr 17 -reg 100 -format float-swap -write 1.5
+func modbusCommand(args []string) error {
+	flags := flag.NewFlagSet("modbus", flag.ContinueOnError)
+	var (
+		configFilename = flags.String("config", "", "файл конфига оборудования, по умолчанию hardware.json приложения")
+		link           = flags.String("link", "", "способ связи: serial, tcp или rtu-tcp")
+		portName       = flags.String("port", "", "имя COM порта")
+		host           = flags.String("host", "", "адрес преобразователя RS-485 - Ethernet, хост:порт")
+		addr           = flags.Uint("addr", 17, "адрес устройства")
+		reg            = flags.Uint("reg", 0, "начальный регистр")
+		count          = flags.Uint("count", 1, "количество регистров чтения")
+		format         = flags.String("format", "uint16", "формат значений: uint16, float или float-swap (младшее слово первым)")
+		write          = flags.String("write", "", "значения для записи через запятую: один регистр - функцией 6, несколько - функцией 16")
+		repeat         = flags.Duration("repeat", 0, "интервал повтора, 0 - выполнить один раз")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cmd, err := hardware.ParseRegisterCommand(*addr, *reg, *count, *format, *write)
+	if err != nil {
+		return err
+	}
+
+	if *configFilename == "" {
+		*configFilename = appFolderFileName("hardware.json")
+	}
+	// диагностика не должна изменять конфиг приложения: конфиг только считывается
+	cfg, err := hardware.ReadConfig(*configFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "конфиг оборудования:", err, "- используются настройки по умолчанию")
+	}
+	if *link != "" {
+		cfg.Link = hardware.Link(*link)
+	}
+	if *portName != "" {
+		cfg.SerialPortName = *portName
+	}
+	if *host != "" {
+		h, p, err := net.SplitHostPort(*host)
+		if err != nil {
+			return err
+		}
+		if cfg.Port, err = strconv.Atoi(p); err != nil {
+			return fmt.Errorf("недопустимый порт: %s", *host)
+		}
+		cfg.Host = h
+	}
+	if err := cfg.Link.Validate(); err != nil {
+		return err
+	}
+
+	port := hardware.ConfigTransport(cfg)
+	if err := port.Open(); err != nil {
+		return err
+	}
+	defer port.Close()
+
+	ctx := context.Background()
+	for {
+		regs, err := cmd.Run(ctx, port)
+		t := time.Now().Format("15:04:05.000")
+		if err != nil {
+			fmt.Println(t, err)
+		} else {
+			for _, line := range cmd.FormatRegisters(regs) {
+				fmt.Println(t, line)
+			}
+		}
+		if *repeat <= 0 {
+			return nil
+		}
+		time.Sleep(*repeat)
+	}
+}
+
+func runModbusCommand() {
+	if err := modbusCommand(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"github.com/fpawel/procmq"
 	"github.com/fpawel/ufo82/internal/hardware"
@@ -26,6 +28,16 @@ const (
 	msgHardwareConfig
 	msgHardwareCurrentPlace
 	msgComPorts
+	msgHardwareReconnect
+	msgHardwareReconnected
+	msgHardwareProbe
+	msgHardwareWrite
+	msgHardwareCalibration
+	msgSensitivityLimits
+	msgHardwareStable
+	msgSensitivityBuckets
+	msgSensitivitiesPage
+	msgProductHistory
 )
 
 type sender struct {
@@ -89,8 +101,26 @@ func (x *sender) writeFloat64(v float64) {
 	x.pipeError = x.conn.WriteFloat64(v)
 }
 
+// dbFailed отправляет сообщение об ошибке запроса к базе данных, если err не nil
+func (x *sender) dbFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	fmt.Println("база данных:", err)
+	x.InfoMessage(InfoMessage{"база данных: " + err.Error(), "clRed"})
+	return true
+}
+
+func dbContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dbTimeout)
+}
+
 func (x *sender) CreateNewParty() {
-	x.db.CreateNewParty()
+	ctx, cancel := dbContext()
+	defer cancel()
+	if x.dbFailed(x.db.CreateNewParty(ctx)) {
+		return
+	}
 	x.years()
 	x.currentParty()
 	x.InfoMessage(InfoMessage{"создана новая партия приборов", "clBlue"})
@@ -100,13 +130,43 @@ func (x *sender) AppConfig(config hardware.Config) {
 	x.writeUInt32(msgHardwareConfig)
 	// отправить имя ком порта из настроек
 	x.writeString(config.SerialPortName)
-	// отправить выбранность мест стенда из настроек
-	for i := 0; i < 10; i++ {
-		v := uint32(0)
-		if config.CheckedPlaces[i] {
-			v = 1
-		}
-		x.writeUInt32(v)
+	// отправить места стенда из настроек: выбранность, адрес, начальный регистр, интервал опроса
+	// и пределы показания
+	x.writeUInt32(uint32(len(config.Places)))
+	for _, p := range config.Places {
+		x.writeUInt32(boolToUInt32(p.Checked))
+		x.writeUInt32(uint32(p.Addr))
+		x.writeUInt32(uint32(p.Register))
+		x.writeUInt32(uint32(p.Interval))
+		x.writeFloat64(p.ValueMin)
+		x.writeFloat64(p.ValueMax)
+	}
+	x.writeUInt32(boolToUInt32(config.BlockRead))
+	x.writeUInt32(uint32(config.CyclePeriod))
+	// отправить способ связи и адрес преобразователя RS-485 - Ethernet
+	x.writeString(string(config.Link))
+	x.writeString(config.Host)
+	x.writeUInt32(uint32(config.Port))
+	// отправить параметры линии связи
+	x.writeUInt32(uint32(config.Comm.Baud))
+	x.writeString(config.Comm.Parity)
+	x.writeUInt32(uint32(config.Comm.StopBits))
+	x.writeUInt32(uint32(config.Comm.ReadTimeout))
+	x.writeUInt32(uint32(config.Comm.ReadByteTimeout))
+	x.writeUInt32(uint32(config.Comm.MaxAttemptsRead))
+	x.writeUInt32(uint32(config.Comm.RequestDelay))
+	x.writeUInt32(boolToUInt32(config.TrafficLog))
+	x.writeUInt32(uint32(config.ScanAddrMin))
+	x.writeUInt32(uint32(config.ScanAddrMax))
+	x.writeUInt32(uint32(config.Stabilization.Window))
+	x.writeFloat64(config.Stabilization.MaxDrift)
+	x.writeFloat64(config.Stabilization.MaxNoise)
+	// отправить флаги слова статуса
+	x.writeUInt32(uint32(len(config.StatusBits)))
+	for _, b := range config.StatusBits {
+		x.writeUInt32(uint32(b.Bit))
+		x.writeString(b.Name)
+		x.writeUInt32(boolToUInt32(b.Fault))
 	}
 	return
 }
@@ -120,31 +180,127 @@ func (x *sender) InfoMessage(m InfoMessage) {
 func (x *sender) party(party ufo82.Party) {
 	x.writeUInt64(uint64(party.PartyID))
 	x.writeTime(party.CreatedAt)
+	// сведения о партии и условия окружающей среды: задано ли и значение
+	x.writeString(party.Name)
+	x.writeString(party.Operator)
+	x.writeString(party.ProductType)
+	x.writeString(party.BatchNumber)
+	x.writeString(party.Notes)
+	for _, v := range []sql.NullFloat64{party.Temperature, party.Humidity, party.Pressure} {
+		x.writeUInt32(boolToUInt32(v.Valid))
+		x.writeFloat64(v.Float64)
+	}
 }
 
-func (x *sender) product(product ufo82.Product) {
+// setPartyInfo сохраняет сведения о партии и отправляет партию, а если она текущая - и текущую
+// партию
+func (x *sender) setPartyInfo(partyID ufo82.PartyID, info ufo82.PartyInfo) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	if x.dbFailed(x.db.SetPartyInfo(ctx, partyID, info)) {
+		return
+	}
+	x.PartyAndItsProducts(partyID)
+	lastPartyID, err := x.db.GetLastPartyID(ctx)
+	if x.dbFailed(err) {
+		return
+	}
+	if lastPartyID == partyID {
+		x.currentParty()
+	}
+}
+
+func (x *sender) product(product ufo82.Product, result ufo82.ProductResult, evaluated bool) {
 	x.writeUInt64(uint64(product.ProductID))
 	x.writeUInt32(uint32(product.Order))
 	x.writeUInt32(uint32(product.ProductNumber))
+	// итог проверки прибора: проверен ли, годен ли, итоговое значение и причина брака
+	x.writeUInt32(boolToUInt32(evaluated))
+	x.writeUInt32(boolToUInt32(result.Passed))
+	x.writeUInt32(boolToUInt32(result.Value.Valid))
+	x.writeFloat64(result.Value.Float64)
+	x.writeString(result.Reason)
 }
 
-func (x *sender) partyAndItsProducts(partyID ufo82.PartyID) {
-	party, products := x.db.GetPartyByID(partyID)
+// partyAndItsProducts отправляет сообщение msg с партией и её приборами
+func (x *sender) partyAndItsProducts(msg uint32, partyID ufo82.PartyID) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	party, products, err := x.db.GetPartyByID(ctx, partyID)
+	if x.dbFailed(err) {
+		return
+	}
+	results, err := x.db.GetPartyResults(ctx, partyID)
+	if x.dbFailed(err) {
+		return
+	}
+	x.writeUInt32(msg)
 	x.party(party)
 	x.writeUInt32(uint32(len(products)))
 	for _, product := range products {
-		x.product(product)
+		result, evaluated := results[product.ProductID]
+		x.product(product, result, evaluated)
 	}
 }
 
+// evaluateParty проверяет приборы партии и отправляет партию с итогами
+func (x *sender) evaluateParty(partyID ufo82.PartyID) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	results, err := x.db.EvaluateParty(ctx, partyID)
+	if x.dbFailed(err) {
+		return
+	}
+	passed := 0
+	for _, r := range results {
+		if r.Passed {
+			passed++
+		}
+	}
+	x.PartyAndItsProducts(partyID)
+	x.InfoMessage(InfoMessage{fmt.Sprintf("партия %d: годных приборов %d из %d", partyID, passed, len(results)), "clNavy"})
+}
+
+func (x *sender) sensitivityLimits() {
+	ctx, cancel := dbContext()
+	defer cancel()
+	limits, err := x.db.GetSensitivityLimits(ctx)
+	if x.dbFailed(err) {
+		return
+	}
+	x.writeUInt32(msgSensitivityLimits)
+	x.writeFloat64(limits.Min)
+	x.writeFloat64(limits.Max)
+}
+
+func (x *sender) setSensitivityLimits(limits ufo82.Limits) {
+	if err := limits.Validate(); err != nil {
+		x.InfoMessage(InfoMessage{err.Error(), "clRed"})
+	} else {
+		ctx, cancel := dbContext()
+		x.dbFailed(x.db.SetSensitivityLimits(ctx, limits))
+		cancel()
+	}
+	x.sensitivityLimits()
+}
+
 func (x *sender) currentParty() {
-	partyID := x.db.GetLastPartyID()
-	x.writeUInt32(msgCurrentParty)
-	x.partyAndItsProducts(partyID)
+	ctx, cancel := dbContext()
+	partyID, err := x.db.GetLastPartyID(ctx)
+	cancel()
+	if x.dbFailed(err) {
+		return
+	}
+	x.partyAndItsProducts(msgCurrentParty, partyID)
 }
 
 func (x *sender) years() {
-	years := x.db.GetYears()
+	ctx, cancel := dbContext()
+	defer cancel()
+	years, err := x.db.GetYears(ctx)
+	if x.dbFailed(err) {
+		return
+	}
 	x.writeUInt32(msgYears)
 	x.writeUInt32(uint32(len(years)))
 	for _, y := range years {
@@ -153,7 +309,12 @@ func (x *sender) years() {
 }
 
 func (x *sender) monthsOfYear(year int) {
-	months := x.db.GetMonthsOfYear(year)
+	ctx, cancel := dbContext()
+	defer cancel()
+	months, err := x.db.GetMonthsOfYear(ctx, year)
+	if x.dbFailed(err) {
+		return
+	}
 	x.writeUInt32(msgMonthsOfYear)
 	x.writeUInt32(uint32(year))
 	x.writeUInt32(uint32(len(months)))
@@ -163,7 +324,12 @@ func (x *sender) monthsOfYear(year int) {
 }
 
 func (x *sender) daysOfYearMonth(ym ufo82.YearMonth) {
-	days := x.db.GetDaysOfYearMonth(ym)
+	ctx, cancel := dbContext()
+	defer cancel()
+	days, err := x.db.GetDaysOfYearMonth(ctx, ym)
+	if x.dbFailed(err) {
+		return
+	}
 	x.writeUInt32(msgDaysOfYearMonth)
 	x.writeUInt32(uint32(ym.Year))
 	x.writeUInt32(uint32(ym.Month))
@@ -174,7 +340,12 @@ func (x *sender) daysOfYearMonth(ym ufo82.YearMonth) {
 }
 
 func (x *sender) partiesOfMonthYearDay(ym ufo82.YearMonthDay) {
-	parties := x.db.GetPartiesOfYearMonthDay(ym)
+	ctx, cancel := dbContext()
+	defer cancel()
+	parties, err := x.db.GetPartiesOfYearMonthDay(ctx, ym)
+	if x.dbFailed(err) {
+		return
+	}
 	x.writeUInt32(msgPartiesOfYearMonthDay)
 	x.writeUInt32(uint32(ym.Year))
 	x.writeUInt32(uint32(ym.Month))
@@ -188,7 +359,12 @@ func (x *sender) partiesOfMonthYearDay(ym ufo82.YearMonthDay) {
 }
 
 func (x *sender) sensitivitiesOfProduct(productID ufo82.ProductID) {
-	ds := x.db.GetSensitivitiesByProductID(productID)
+	ctx, cancel := dbContext()
+	defer cancel()
+	ds, err := x.db.GetSensitivitiesByProductID(ctx, productID)
+	if x.dbFailed(err) {
+		return
+	}
 
 	x.writeUInt32(msgSensitivitiesOfProduct)
 	x.writeUInt64(uint64(productID))
@@ -201,13 +377,94 @@ func (x *sender) sensitivitiesOfProduct(productID ufo82.ProductID) {
 	return
 }
 
+// sensitivityBuckets отправляет ряд чувствительностей прибора по интервалам времени: начало
+// интервала, количество, наименьшее, наибольшее и среднее значения
+func (x *sender) sensitivityBuckets(r sensitivityBucketsRequest) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	buckets, err := x.db.GetSensitivityBuckets(ctx, r.productID, r.from, r.to, r.count)
+	if x.dbFailed(err) {
+		return
+	}
+	x.writeUInt32(msgSensitivityBuckets)
+	x.writeUInt64(uint64(r.productID))
+	x.writeUInt32(uint32(len(buckets)))
+	for _, b := range buckets {
+		x.writeTime(b.StartsAt)
+		x.writeUInt32(uint32(b.Count))
+		x.writeFloat64(b.Min)
+		x.writeFloat64(b.Max)
+		x.writeFloat64(b.Mean)
+	}
+}
+
+// sensitivitiesPage отправляет страницу чувствительностей прибора вместе с запрошенными курсором
+// и направлением, чтобы получатель мог сопоставить её с запросом, и курсором следующей страницы
+func (x *sender) sensitivitiesPage(q ufo82.SensitivitiesQuery) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	page, err := x.db.GetSensitivitiesPage(ctx, q)
+	if x.dbFailed(err) {
+		return
+	}
+	x.writeUInt32(msgSensitivitiesPage)
+	x.writeUInt64(uint64(q.ProductID))
+	x.writeUInt64(uint64(q.Cursor))
+	x.writeUInt32(boolToUInt32(q.Backward))
+	x.writeUInt64(uint64(page.Next))
+	x.writeUInt32(uint32(len(page.Sensitivities)))
+	for _, s := range page.Sensitivities {
+		x.writeTime(s.StoredAt)
+		x.writeFloat64(s.Value)
+	}
+}
+
+// productHistory отправляет приборы с заводскими номерами из диапазона r во всех партиях:
+// прибор, дату партии, сводку чувствительностей и итог проверки. Перед списком отправляется
+// количество всех приборов диапазона: список ограничен ufo82.MaxProductHistory
+func (x *sender) productHistory(r serialRange) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	xs, total, err := x.db.GetProductHistory(ctx, r.min, r.max)
+	if x.dbFailed(err) {
+		return
+	}
+	x.writeUInt32(msgProductHistory)
+	x.writeUInt32(uint32(r.min))
+	x.writeUInt32(uint32(r.max))
+	x.writeUInt32(uint32(total))
+	x.writeUInt32(uint32(len(xs)))
+	for _, h := range xs {
+		x.writeUInt64(uint64(h.ProductID))
+		x.writeUInt64(uint64(h.PartyID))
+		x.writeTime(h.PartyCreatedAt)
+		x.writeUInt32(uint32(h.Order))
+		x.writeUInt32(uint32(h.ProductNumber))
+		x.writeUInt32(uint32(h.SensitivitiesCount))
+		x.writeFloat64(h.Min.Float64)
+		x.writeFloat64(h.Max.Float64)
+		x.writeFloat64(h.Mean.Float64)
+		x.writeTime(h.FirstStoredAt)
+		x.writeTime(h.LastStoredAt)
+		x.writeUInt32(boolToUInt32(h.Evaluated))
+		x.writeUInt32(boolToUInt32(h.Passed))
+		x.writeUInt32(boolToUInt32(h.ResultValue.Valid))
+		x.writeFloat64(h.ResultValue.Float64)
+		x.writeString(h.Reason)
+	}
+}
+
 func (x *sender) PartyAndItsProducts(partyID ufo82.PartyID) {
-	x.writeUInt32(msgProductsOfParty)
-	x.partyAndItsProducts(partyID)
+	x.partyAndItsProducts(msgProductsOfParty, partyID)
 }
 
 func (x *sender) applyCurrentProductOrderSerial(inp ufo82.ProductOrderSerial) {
-	msg := x.db.ApplyCurrentProductSerial(inp)
+	ctx, cancel := dbContext()
+	msg, err := x.db.ApplyCurrentProductSerial(ctx, inp)
+	cancel()
+	if x.dbFailed(err) {
+		return
+	}
 	x.currentParty()
 	x.years()
 	x.InfoMessage(InfoMessage{msg, "clNavy"})
@@ -223,8 +480,14 @@ func (x *sender) HardwareReading(s hardware.Reading) {
 	x.writeUInt32(uint32(s.Pin))
 	x.writeUInt32(uint32(s.Status))
 	x.writeFloat64(float64(s.Value))
+	// отправить названия установленных флагов статуса
+	x.writeUInt32(uint32(len(s.Flags)))
+	for _, flag := range s.Flags {
+		x.writeString(flag)
+	}
 	x.writeString(errStr)
-
+	// показание установилось: признак сбрасывается, когда показание снова изменяется
+	x.writeUInt32(boolToUInt32(s.Stable))
 }
 
 func (x *sender) HardwareConnected() {
@@ -241,6 +504,16 @@ func (x *sender) HardwareConnectionError(errStr string) {
 	x.writeString(errStr)
 }
 
+func (x *sender) HardwareReconnect(attempt int, delay time.Duration) {
+	x.writeUInt32(msgHardwareReconnect)
+	x.writeUInt32(uint32(attempt))
+	x.writeUInt32(uint32(delay / time.Millisecond))
+}
+
+func (x *sender) HardwareReconnected() {
+	x.writeUInt32(msgHardwareReconnected)
+}
+
 func (x *sender) HardwareCurrentPlace(n int) {
 	x.writeUInt32(msgHardwareCurrentPlace)
 	x.writeUInt32(uint32(n))
@@ -254,3 +527,63 @@ func (x *sender) ComPorts(ports []string) {
 	}
 
 }
+
+// HardwareProbe отправляет результат поиска стенда: для каждого порта адреса ответивших устройств
+func (x *sender) HardwareProbe(results []hardware.ProbeResult) {
+	x.writeUInt32(msgHardwareProbe)
+	x.writeUInt32(uint32(len(results)))
+	for _, r := range results {
+		x.writeString(r.Port)
+		x.writeUInt32(uint32(len(r.Addrs)))
+		for _, addr := range r.Addrs {
+			x.writeUInt32(uint32(addr))
+		}
+	}
+}
+
+// HardwareWrite отправляет результат записи регистров места
+func (x *sender) HardwareWrite(w hardware.RegisterWrite) {
+	errStr := ""
+	if w.Error != nil {
+		errStr = w.Error.Error()
+	}
+	x.writeUInt32(msgHardwareWrite)
+	x.writeUInt32(uint32(w.Pin))
+	x.writeUInt32(uint32(w.Offset))
+	x.writeUInt32(uint32(len(w.Values)))
+	for _, v := range w.Values {
+		x.writeUInt32(uint32(v))
+	}
+	x.writeString(errStr)
+}
+
+// HardwareCalibration отправляет результат калибровки места: точку калибровки, усреднённое
+// показание и коэффициенты
+func (x *sender) HardwareCalibration(r calibrationResult) {
+	errStr := ""
+	if r.err != nil {
+		errStr = r.err.Error()
+	}
+	x.writeUInt32(msgHardwareCalibration)
+	x.writeUInt32(uint32(r.pin))
+	x.writeUInt32(uint32(r.point))
+	x.writeFloat64(r.value)
+	x.writeFloat64(r.calibration.Offset)
+	x.writeFloat64(r.calibration.Gain)
+	x.writeString(errStr)
+}
+
+// HardwareStable отправляет место, показание которого установилось, время и значение показания
+func (x *sender) HardwareStable(r hardware.Reading) {
+	x.writeUInt32(msgHardwareStable)
+	x.writeUInt32(uint32(r.Pin))
+	x.writeTime(r.Time)
+	x.writeFloat64(float64(r.Value))
+}
+
+func boolToUInt32(v bool) uint32 {
+	if v {
+		return 1
+	}
+	return 0
+}
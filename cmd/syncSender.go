@@ -4,6 +4,7 @@ import (
 	"github.com/fpawel/ufo82/internal/hardware"
 	"github.com/fpawel/ufo82/internal/ufo82"
 	"net"
+	"time"
 )
 
 type syncSender struct {
@@ -14,21 +15,61 @@ type syncSender struct {
 
 	hardwareConnected,
 	hardwareDisconnected,
+	hardwareReconnected,
 	newParty chan bool
+	hardwareReconnect              chan hardwareReconnect
 	monthsOfYear                   chan int
 	partiesOfYearMonthDay          chan ufo82.YearMonthDay
 	daysOfYearMonth                chan ufo82.YearMonth
 	productsOfParty                chan ufo82.PartyID
 	sensitivitiesOfProduct         chan ufo82.ProductID
+	sensitivityBuckets             chan sensitivityBucketsRequest
+	sensitivitiesPage              chan ufo82.SensitivitiesQuery
+	productHistory                 chan serialRange
+	partyInfo                      chan partyInfo
 	applyCurrentProductOrderSerial chan ufo82.ProductOrderSerial
 	hardwareReading                chan hardware.Reading
 	infoMessage                    chan InfoMessage
 	hardwareConfig                 chan hardware.Config
 	hardwareCurrentPlace           chan int
 	comports                       chan []string
+	hardwareProbe                  chan []hardware.ProbeResult
+	hardwareWrite                  chan hardware.RegisterWrite
+	hardwareCalibration            chan calibrationResult
+	hardwareStable                 chan hardware.Reading
+	evaluateParty                  chan ufo82.PartyID
+	sensitivityLimits              chan ufo82.Limits
+	// partyChanged вызывается после изменения состава текущей партии
+	partyChanged func()
+	// flushDB вызывается перед операциями над партией, чтобы в базе данных были все
+	// полученные показания
+	flushDB func()
 }
 
-func newSyncSender(writerPipeConn net.Conn, db ufo82.DB) (x syncSender) {
+// sensitivityBucketsRequest - запрос ряда чувствительностей прибора, разбитого на count
+// интервалов времени от from до to
+type sensitivityBucketsRequest struct {
+	productID ufo82.ProductID
+	from, to  time.Time
+	count     int
+}
+
+// serialRange - диапазон заводских номеров приборов
+type serialRange struct {
+	min, max int64
+}
+
+type partyInfo struct {
+	partyID ufo82.PartyID
+	info    ufo82.PartyInfo
+}
+
+type hardwareReconnect struct {
+	attempt int
+	delay   time.Duration
+}
+
+func newSyncSender(writerPipeConn net.Conn, db ufo82.DB, partyChanged, flushDB func()) (x syncSender) {
 
 	sender := newSender(db, writerPipeConn)
 
@@ -38,13 +79,26 @@ func newSyncSender(writerPipeConn net.Conn, db ufo82.DB) (x syncSender) {
 	// отправить текущую партию
 	sender.currentParty()
 
+	// отправить пределы чувствительности
+	sender.sensitivityLimits()
+
+	x.partyChanged = partyChanged
+	x.flushDB = flushDB
 	x.done = make(chan error)
 	x.comports = make(chan []string)
+	x.hardwareProbe = make(chan []hardware.ProbeResult)
+	x.hardwareWrite = make(chan hardware.RegisterWrite)
+	x.hardwareCalibration = make(chan calibrationResult)
+	x.hardwareStable = make(chan hardware.Reading)
+	x.evaluateParty = make(chan ufo82.PartyID)
+	x.sensitivityLimits = make(chan ufo82.Limits)
 	x.interrupt = make(chan bool, 2)
 	x.years = make(chan bool)
 	x.newParty = make(chan bool)
 	x.hardwareConnected = make(chan bool)
 	x.hardwareDisconnected = make(chan bool)
+	x.hardwareReconnected = make(chan bool)
+	x.hardwareReconnect = make(chan hardwareReconnect)
 	x.hardwareConnectionError = make(chan string)
 	x.monthsOfYear = make(chan int)
 	x.partiesOfYearMonthDay = make(chan ufo82.YearMonthDay)
@@ -52,6 +106,10 @@ func newSyncSender(writerPipeConn net.Conn, db ufo82.DB) (x syncSender) {
 
 	x.productsOfParty = make(chan ufo82.PartyID)
 	x.sensitivitiesOfProduct = make(chan ufo82.ProductID)
+	x.sensitivityBuckets = make(chan sensitivityBucketsRequest)
+	x.sensitivitiesPage = make(chan ufo82.SensitivitiesQuery)
+	x.productHistory = make(chan serialRange)
+	x.partyInfo = make(chan partyInfo)
 	x.applyCurrentProductOrderSerial = make(chan ufo82.ProductOrderSerial)
 	x.hardwareReading = make(chan hardware.Reading)
 	x.infoMessage = make(chan InfoMessage)
@@ -96,10 +154,34 @@ func (x syncSender) SendSensitivitiesOfProduct(productID ufo82.ProductID) {
 	x.sensitivitiesOfProduct <- productID
 }
 
+func (x syncSender) SendSensitivityBuckets(r sensitivityBucketsRequest) {
+	x.sensitivityBuckets <- r
+}
+
+func (x syncSender) SendSensitivitiesPage(q ufo82.SensitivitiesQuery) {
+	x.sensitivitiesPage <- q
+}
+
+func (x syncSender) SendProductHistory(r serialRange) {
+	x.productHistory <- r
+}
+
+func (x syncSender) SetPartyInfo(partyID ufo82.PartyID, info ufo82.PartyInfo) {
+	x.partyInfo <- partyInfo{partyID, info}
+}
+
 func (x syncSender) ApplyCurrentProductOrderSerial(p ufo82.ProductOrderSerial) {
 	x.applyCurrentProductOrderSerial <- p
 }
 
+func (x syncSender) EvaluateParty(partyID ufo82.PartyID) {
+	x.evaluateParty <- partyID
+}
+
+func (x syncSender) SetSensitivityLimits(limits ufo82.Limits) {
+	x.sensitivityLimits <- limits
+}
+
 func (x syncSender) SendInfoMessage(m InfoMessage) {
 	x.infoMessage <- m
 }
@@ -115,6 +197,14 @@ func (x syncSender) HardwareDisconnected() {
 	x.hardwareDisconnected <- true
 }
 
+func (x syncSender) HardwareReconnect(attempt int, delay time.Duration) {
+	x.hardwareReconnect <- hardwareReconnect{attempt, delay}
+}
+
+func (x syncSender) HardwareReconnected() {
+	x.hardwareReconnected <- true
+}
+
 func (x syncSender) HardwareConnectionError(errStr string) {
 	x.hardwareConnectionError <- errStr
 }
@@ -131,12 +221,27 @@ func (x syncSender) ComPorts(ports []string) {
 	x.comports <- ports
 }
 
+func (x syncSender) HardwareProbe(results []hardware.ProbeResult) {
+	x.hardwareProbe <- results
+}
+
+func (x syncSender) HardwareWrite(w hardware.RegisterWrite) {
+	x.hardwareWrite <- w
+}
+
+func (x syncSender) HardwareStable(r hardware.Reading) {
+	x.hardwareStable <- r
+}
+
+func (x syncSender) HardwareCalibration(r calibrationResult) {
+	x.hardwareCalibration <- r
+}
+
 func (x syncSender) run(senderMessages *sender) {
 
 	defer func() {
 		x.done <- senderMessages.pipeError
 	}()
-	var currentProducts []ufo82.Product
 
 	for {
 
@@ -146,8 +251,9 @@ func (x syncSender) run(senderMessages *sender) {
 			return
 
 		case <-x.newParty:
+			x.flushDB()
 			senderMessages.CreateNewParty()
-			currentProducts = senderMessages.db.GetLastPartyProducts()
+			x.partyChanged()
 
 		case <-x.years:
 			senderMessages.years()
@@ -167,34 +273,48 @@ func (x syncSender) run(senderMessages *sender) {
 		case productID := <-x.sensitivitiesOfProduct:
 			senderMessages.sensitivitiesOfProduct(productID)
 
+		case r := <-x.sensitivityBuckets:
+			senderMessages.sensitivityBuckets(r)
+
+		case q := <-x.sensitivitiesPage:
+			senderMessages.sensitivitiesPage(q)
+
+		case r := <-x.productHistory:
+			senderMessages.productHistory(r)
+
+		case p := <-x.partyInfo:
+			senderMessages.setPartyInfo(p.partyID, p.info)
+
 		case z := <-x.applyCurrentProductOrderSerial:
 			senderMessages.applyCurrentProductOrderSerial(z)
-			currentProducts = senderMessages.db.GetLastPartyProducts()
+			x.partyChanged()
+
+		case partyID := <-x.evaluateParty:
+			x.flushDB()
+			senderMessages.evaluateParty(partyID)
+
+		case limits := <-x.sensitivityLimits:
+			senderMessages.setSensitivityLimits(limits)
 
 		case m := <-x.infoMessage:
 			senderMessages.InfoMessage(m)
 
 		case <-x.hardwareConnected:
-			currentProducts = senderMessages.db.GetLastPartyProducts()
-			for _, p := range currentProducts {
-				senderMessages.db.ClearProductSensitivities(p.ProductID)
-			}
 			senderMessages.HardwareConnected()
 
 		case <-x.hardwareDisconnected:
 			senderMessages.HardwareDisconnected()
 
+		case r := <-x.hardwareReconnect:
+			senderMessages.HardwareReconnect(r.attempt, r.delay)
+
+		case <-x.hardwareReconnected:
+			senderMessages.HardwareReconnected()
+
 		case errStr := <-x.hardwareConnectionError:
 			senderMessages.HardwareConnectionError(errStr)
 
 		case s := <-x.hardwareReading:
-			if s.Error == nil {
-				for _, p := range currentProducts {
-					if p.Order == int64(s.Pin) {
-						senderMessages.db.AddNewSensitivity(p.ProductID, s.Value)
-					}
-				}
-			}
 			senderMessages.HardwareReading(s)
 
 		case config := <-x.hardwareConfig:
@@ -206,6 +326,18 @@ func (x syncSender) run(senderMessages *sender) {
 		case ports := <-x.comports:
 			senderMessages.ComPorts(ports)
 
+		case results := <-x.hardwareProbe:
+			senderMessages.HardwareProbe(results)
+
+		case w := <-x.hardwareWrite:
+			senderMessages.HardwareWrite(w)
+
+		case r := <-x.hardwareStable:
+			senderMessages.HardwareStable(r)
+
+		case r := <-x.hardwareCalibration:
+			senderMessages.HardwareCalibration(r)
+
 		}
 	}
 }
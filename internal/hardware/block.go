@@ -0,0 +1,138 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/fpawel/guartutils/modbus"
+	"math"
+	"sort"
+)
+
+// maxBlockRegisters - наибольшее количество регистров в одном запросе функции 3
+const maxBlockRegisters = 125
+
+// placesPoll - места одного устройства, считываемые за один опрос: блоком одним запросом
+// или, если не block, по одному месту двумя запросами
+type placesPoll struct {
+	pins  []int
+	block bool
+}
+
+// makePolls разбивает выбранные места на опросы. Места устройств из rejectBlock
+// опрашиваются по одному
+func makePolls(cfg Config, rejectBlock map[byte]bool) (polls []placesPoll) {
+	byAddr := make(map[byte][]int)
+	var addrs []byte
+	for pin, p := range cfg.Places {
+		if !p.Checked {
+			continue
+		}
+		if !cfg.BlockRead || rejectBlock[p.Addr] {
+			polls = append(polls, placesPoll{pins: []int{pin}})
+			continue
+		}
+		if _, f := byAddr[p.Addr]; !f {
+			addrs = append(addrs, p.Addr)
+		}
+		byAddr[p.Addr] = append(byAddr[p.Addr], pin)
+	}
+	for _, addr := range addrs {
+		pins := byAddr[addr]
+		sort.Slice(pins, func(i, j int) bool {
+			return cfg.Places[pins[i]].Register < cfg.Places[pins[j]].Register
+		})
+		var b placesPoll
+		for _, pin := range pins {
+			if len(b.pins) > 0 && int(cfg.Places[pin].Register)+6-int(cfg.Places[b.pins[0]].Register) > maxBlockRegisters {
+				polls = append(polls, b)
+				b = placesPoll{}
+			}
+			b.block = true
+			b.pins = append(b.pins, pin)
+		}
+		polls = append(polls, b)
+	}
+	return
+}
+
+// poll считывает места опроса p. Если устройство отвергает чтение блока или не отвечает на него,
+// места считываются по одному, и, если так они считываются, устройство заносится в rejectBlock
+func poll(ctx context.Context, port Transport, cfg Config, p placesPoll, rejectBlock map[byte]bool) []Reading {
+	if !p.block {
+		return []Reading{readPin(ctx, port, cfg, p.pins[0])}
+	}
+	readings, rejected, unanswered := readBlock(ctx, port, cfg, p.pins)
+	if !rejected && !(unanswered && len(p.pins) > 1) {
+		return readings
+	}
+	// устройство отклонило запрос или не ответило на него: прошивки, не поддерживающие длинные
+	// запросы, могут и не отвечать. Если места считываются по одному, блок больше не запрашивается
+	errBlock := readings[0].Error
+	readings = nil
+	for _, pin := range p.pins {
+		reading := readPin(ctx, port, cfg, pin)
+		readings = append(readings, reading)
+		if reading.Error == nil {
+			rejected = true
+		}
+		if connectionFailed(reading.Error) {
+			break
+		}
+	}
+	if rejected {
+		addr := cfg.Places[p.pins[0]].Addr
+		fmt.Printf("устройство %d не поддерживает чтение блока регистров: %v\n", addr, errBlock)
+		rejectBlock[addr] = true
+	}
+	return readings
+}
+
+// readBlock считывает места pins одного устройства одним запросом.
+// rejected - устройство не поддерживает такой запрос: ответило исключением modbus 1
+// (недопустимая функция), 2 (недопустимый адрес) или 3 (недопустимое количество регистров).
+// Прочие исключения, например 6 (устройство занято), - обычная ошибка чтения.
+// unanswered - устройство не ответило за все попытки чтения
+func readBlock(ctx context.Context, port Transport, cfg Config, pins []int) (readings []Reading, rejected, unanswered bool) {
+	places := cfg.Places
+	first := places[pins[0]].Register
+	count := places[pins[len(pins)-1]].Register + 6 - first
+	request := modbus.Request{
+		Addr:                modbus.Addr(places[pins[0]].Addr),
+		ProtocolCommandCode: 3,
+		Data:                registersData(first, count),
+	}
+	bytes, err := port.Fetch(withPins(ctx, pins...), request.Bytes())
+	if err != nil {
+		unanswered = ctx.Err() == nil && !connectionFailed(err)
+	} else if code, f := exceptionCode(bytes); f {
+		err, rejected = fmt.Errorf("% X: исключение modbus %d", bytes, code), code >= 1 && code <= 3
+	}
+	if err == nil {
+		err = request.CheckResponse(bytes)
+	}
+	if err == nil && len(bytes) != 5+2*int(count) {
+		err = fmt.Errorf("длина ответа не %d: % X", 5+2*int(count), bytes)
+	}
+	for _, pin := range pins {
+		reading := Reading{Pin: pin, Error: err}
+		if err == nil {
+			n := 3 + 2*int(places[pin].Register-first)
+			reading.Status = binary.BigEndian.Uint16(bytes[n+4:])
+			if reading.Flags, reading.Error = decodeStatus(reading.Status, cfg.StatusBits); reading.Error == nil {
+				reading.Value = math.Float32frombits(binary.BigEndian.Uint32(bytes[n+8:]))
+				reading.Error = places[pin].valueError(reading.Value)
+			}
+		}
+		readings = append(readings, reading)
+	}
+	return
+}
+
+// exceptionCode возвращает код исключения, если bytes - ответ modbus RTU с исключением
+func exceptionCode(bytes []byte) (byte, bool) {
+	if len(bytes) == 5 && bytes[1]&0x80 != 0 && crc16(bytes) == 0 {
+		return bytes[2], true
+	}
+	return 0, false
+}
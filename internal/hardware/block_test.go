@@ -0,0 +1,88 @@
+package hardware
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMakePolls(t *testing.T) {
+	cfg := defaultConfig()
+	for i := range cfg.Places {
+		cfg.Places[i].Checked = i != 1
+	}
+
+	polls := makePolls(cfg, nil)
+	if len(polls) != 9 {
+		t.Fatalf("per place: %+v", polls)
+	}
+
+	cfg.BlockRead = true
+	polls = makePolls(cfg, map[byte]bool{})
+	want := []placesPoll{
+		{pins: []int{0, 2, 3, 4}, block: true},
+		{pins: []int{5, 6, 7, 8, 9}, block: true},
+	}
+	if !reflect.DeepEqual(polls, want) {
+		t.Fatalf("block: %+v", polls)
+	}
+
+	polls = makePolls(cfg, map[byte]bool{17: true})
+	want = []placesPoll{
+		{pins: []int{0}},
+		{pins: []int{2}},
+		{pins: []int{3}},
+		{pins: []int{4}},
+		{pins: []int{5, 6, 7, 8, 9}, block: true},
+	}
+	if !reflect.DeepEqual(polls, want) {
+		t.Fatalf("rejected block: %+v", polls)
+	}
+
+	// блок не длиннее 125 регистров
+	cfg.Places = StandPlaces([]byte{1}, 30)
+	for i := range cfg.Places {
+		cfg.Places[i].Checked = true
+	}
+	polls = makePolls(cfg, nil)
+	if len(polls) != 2 || len(polls[0].pins) != 20 || len(polls[1].pins) != 10 {
+		t.Fatalf("long block: %+v", polls)
+	}
+}
+
+func TestReadBlockException(t *testing.T) {
+	cfg := defaultConfig()
+	for _, c := range []struct {
+		code     byte
+		rejected bool
+	}{
+		{1, true},
+		{2, true},
+		{3, true},
+		{6, false},
+	} {
+		port := &Loopback{Handler: func(request []byte) []byte {
+			return appendCRC16([]byte{request[0], request[1] | 0x80, c.code})
+		}}
+		port.Open()
+		readings, rejected, unanswered := readBlock(context.Background(), port, cfg, []int{0, 1})
+		if rejected != c.rejected || unanswered || len(readings) != 2 || readings[0].Error == nil || readings[1].Error == nil {
+			t.Errorf("исключение %d: %v %+v", c.code, rejected, readings)
+		}
+	}
+}
+
+func TestReadBlockUnanswered(t *testing.T) {
+	port := &Loopback{Handler: func([]byte) []byte {
+		return nil
+	}}
+	port.Open()
+	readings, rejected, unanswered := readBlock(context.Background(), port, defaultConfig(), []int{0, 1})
+	if rejected || !unanswered || readings[0].Error != ErrTimeout {
+		t.Errorf("%v %v %+v", rejected, unanswered, readings)
+	}
+	port.Close()
+	if _, _, unanswered := readBlock(context.Background(), port, defaultConfig(), []int{0, 1}); unanswered {
+		t.Error("closed port: unanswered")
+	}
+}
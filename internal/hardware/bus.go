@@ -0,0 +1,280 @@
+package hardware
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event - событие оборудования, рассылаемое подписчикам Bus
+type Event interface {
+	// Dispatch вызывает соответствующий событию метод peer
+	Dispatch(peer Peer)
+}
+
+type (
+	EventConnected       struct{}
+	EventDisconnected    struct{}
+	EventConnectionError struct{ Text string }
+	EventReconnect       struct {
+		Attempt int
+		Delay   time.Duration
+	}
+	EventReconnected  struct{}
+	EventReading      struct{ Reading }
+	EventCurrentPlace struct{ Place int }
+	EventConfig       struct{ Config }
+	EventPorts        struct{ Ports []string }
+	EventProbe        struct{ Results []ProbeResult }
+	EventWrite        struct{ RegisterWrite }
+	EventStable       struct{ Reading }
+)
+
+func (x EventConnected) Dispatch(peer Peer)       { peer.HardwareConnected() }
+func (x EventDisconnected) Dispatch(peer Peer)    { peer.HardwareDisconnected() }
+func (x EventConnectionError) Dispatch(peer Peer) { peer.HardwareConnectionError(x.Text) }
+func (x EventReconnect) Dispatch(peer Peer)       { peer.HardwareReconnect(x.Attempt, x.Delay) }
+func (x EventReconnected) Dispatch(peer Peer)     { peer.HardwareReconnected() }
+func (x EventReading) Dispatch(peer Peer)         { peer.HardwareReading(x.Reading) }
+func (x EventCurrentPlace) Dispatch(peer Peer)    { peer.HardwareCurrentPlace(x.Place) }
+func (x EventConfig) Dispatch(peer Peer)          { peer.HardwareConfig(x.Config) }
+func (x EventPorts) Dispatch(peer Peer)           { peer.ComPorts(x.Ports) }
+func (x EventProbe) Dispatch(peer Peer)           { peer.HardwareProbe(x.Results) }
+func (x EventWrite) Dispatch(peer Peer)           { peer.HardwareWrite(x.RegisterWrite) }
+func (x EventStable) Dispatch(peer Peer)          { peer.HardwareStable(x.Reading) }
+
+// Bus рассылает события оборудования независимым подписчикам. Bus реализует Peer, поэтому
+// передаётся в NewProvider вместо единственного получателя событий.
+// У каждого подписчика свой буфер событий: если подписчик не успевает их обрабатывать и буфер
+// заполнен, новые события для него отбрасываются, не задерживая опрос. Подписчику, которому
+// нельзя терять события, буфер без ограничения размера даёт SubscribeUnbounded
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+type Subscription struct {
+	// C - канал событий подписчика, закрывается при отписке или закрытии Bus
+	C       <-chan Event
+	Name    string
+	c       chan Event
+	dropped int64
+	// queue - очередь подписки без ограничения размера, nil для подписки с буфером
+	queue *eventQueue
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe добавляет подписчика с буфером на size событий
+func (x *Bus) Subscribe(name string, size int) *Subscription {
+	c := make(chan Event, size)
+	s := &Subscription{C: c, Name: name, c: c}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		close(c)
+	} else {
+		x.subs[s] = struct{}{}
+	}
+	return s
+}
+
+// SubscribeUnbounded добавляет подписчика, события которого не отбрасываются: они копятся в
+// очереди до чтения из C. При отписке или закрытии Bus канал C закрывается после передачи
+// накопленных событий
+func (x *Bus) SubscribeUnbounded(name string) *Subscription {
+	c := make(chan Event)
+	s := &Subscription{C: c, Name: name, c: c, queue: newEventQueue()}
+	go s.queue.pump(c)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		s.queue.close()
+	} else {
+		x.subs[s] = struct{}{}
+	}
+	return s
+}
+
+func (x *Bus) Unsubscribe(s *Subscription) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, f := x.subs[s]; f {
+		delete(x.subs, s)
+		s.close()
+	}
+}
+
+// Close отписывает всех подписчиков. События, опубликованные после Close, отбрасываются
+func (x *Bus) Close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for s := range x.subs {
+		s.close()
+	}
+	x.subs = nil
+	x.closed = true
+}
+
+func (x *Bus) Publish(e Event) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for s := range x.subs {
+		if s.queue != nil {
+			s.queue.push(e)
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// PublishTo передаёт событие только подписчику s, после уже опубликованных для него событий.
+// Возвращает false, если s отписан
+func (x *Bus) PublishTo(s *Subscription, e Event) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, f := x.subs[s]; !f {
+		return false
+	}
+	if s.queue != nil {
+		s.queue.push(e)
+		return true
+	}
+	select {
+	case s.c <- e:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return true
+}
+
+func (x *Subscription) close() {
+	if x.queue != nil {
+		x.queue.close()
+	} else {
+		close(x.c)
+	}
+}
+
+// Dropped - количество событий, отброшенных из-за переполнения буфера подписчика
+func (x *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&x.dropped)
+}
+
+// Forward передаёт события подписки peer до закрытия канала подписки
+func (x *Subscription) Forward(peer Peer) {
+	for e := range x.C {
+		e.Dispatch(peer)
+	}
+}
+
+func (x *Bus) HardwareConnected() {
+	x.Publish(EventConnected{})
+}
+
+func (x *Bus) HardwareDisconnected() {
+	x.Publish(EventDisconnected{})
+}
+
+func (x *Bus) HardwareConnectionError(s string) {
+	x.Publish(EventConnectionError{s})
+}
+
+func (x *Bus) HardwareReconnect(attempt int, delay time.Duration) {
+	x.Publish(EventReconnect{attempt, delay})
+}
+
+func (x *Bus) HardwareReconnected() {
+	x.Publish(EventReconnected{})
+}
+
+func (x *Bus) HardwareReading(r Reading) {
+	x.Publish(EventReading{r})
+}
+
+func (x *Bus) HardwareCurrentPlace(place int) {
+	x.Publish(EventCurrentPlace{place})
+}
+
+func (x *Bus) HardwareConfig(cfg Config) {
+	// места копируются: Provider продолжает изменять конфиг после рассылки
+	cfg.Places = append([]Place(nil), cfg.Places...)
+	x.Publish(EventConfig{cfg})
+}
+
+func (x *Bus) ComPorts(ports []string) {
+	x.Publish(EventPorts{ports})
+}
+
+func (x *Bus) HardwareProbe(results []ProbeResult) {
+	x.Publish(EventProbe{results})
+}
+
+func (x *Bus) HardwareWrite(w RegisterWrite) {
+	x.Publish(EventWrite{w})
+}
+
+func (x *Bus) HardwareStable(r Reading) {
+	x.Publish(EventStable{r})
+}
+
+// eventQueue - очередь событий подписки без ограничения размера
+type eventQueue struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+	// signal сообщает pump о новых событиях или закрытии
+	signal chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{signal: make(chan struct{}, 1)}
+}
+
+func (x *eventQueue) push(e Event) {
+	x.mu.Lock()
+	x.events = append(x.events, e)
+	x.mu.Unlock()
+	x.notify()
+}
+
+func (x *eventQueue) close() {
+	x.mu.Lock()
+	x.closed = true
+	x.mu.Unlock()
+	x.notify()
+}
+
+func (x *eventQueue) notify() {
+	select {
+	case x.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pump передаёт события очереди в c, пока очередь не закрыта, и закрывает c
+func (x *eventQueue) pump(c chan<- Event) {
+	defer close(c)
+	for {
+		x.mu.Lock()
+		events, closed := x.events, x.closed
+		x.events = nil
+		x.mu.Unlock()
+		for _, e := range events {
+			c <- e
+		}
+		if closed {
+			return
+		}
+		if len(events) == 0 {
+			<-x.signal
+		}
+	}
+}
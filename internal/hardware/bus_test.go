@@ -0,0 +1,89 @@
+package hardware
+
+import (
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	x := NewBus()
+	fast := x.Subscribe("fast", 10)
+	slow := x.Subscribe("slow", 1)
+
+	x.HardwareConnected()
+	x.HardwareReading(Reading{Pin: 3, Value: 1})
+	x.HardwareCurrentPlace(3)
+
+	if n := slow.Dropped(); n != 2 {
+		t.Errorf("slow dropped %d", n)
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Errorf("fast dropped %d", n)
+	}
+	if e := <-slow.C; e != (EventConnected{}) {
+		t.Errorf("slow: %#v", e)
+	}
+
+	x.Unsubscribe(slow)
+	if _, ok := <-slow.C; ok {
+		t.Error("slow not closed")
+	}
+	x.Close()
+
+	peer := newTestPeer()
+	fast.Forward(peer)
+	if !peer.connected {
+		t.Error("not connected")
+	}
+	if r := <-peer.readings; r.Pin != 3 || r.Value != 1 {
+		t.Errorf("%+v", r)
+	}
+
+	if _, ok := <-x.Subscribe("closed", 1).C; ok {
+		t.Error("subscription to closed bus")
+	}
+}
+
+func TestBusUnbounded(t *testing.T) {
+	x := NewBus()
+	s := x.SubscribeUnbounded("db")
+	for i := 0; i < 1000; i++ {
+		x.HardwareReading(Reading{Pin: i})
+	}
+	x.Close()
+	n := 0
+	for e := range s.C {
+		if r := e.(EventReading); r.Pin != n {
+			t.Fatalf("%d: %+v", n, r)
+		}
+		n++
+	}
+	if n != 1000 || s.Dropped() != 0 {
+		t.Fatalf("received %d, dropped %d", n, s.Dropped())
+	}
+	if _, ok := <-x.SubscribeUnbounded("closed").C; ok {
+		t.Error("subscription to closed bus")
+	}
+}
+
+func TestBusPublishTo(t *testing.T) {
+	x := NewBus()
+	s := x.SubscribeUnbounded("db")
+	other := x.Subscribe("other", 10)
+	x.HardwareReading(Reading{Pin: 1})
+	if !x.PublishTo(s, EventCurrentPlace{2}) {
+		t.Fatal("not published")
+	}
+	if e, ok := (<-s.C).(EventReading); !ok || e.Pin != 1 {
+		t.Fatalf("%+v", e)
+	}
+	if e := <-s.C; e != (EventCurrentPlace{2}) {
+		t.Fatalf("%+v", e)
+	}
+	if len(other.C) != 1 {
+		t.Fatalf("other: %d events", len(other.C))
+	}
+	x.Unsubscribe(s)
+	if x.PublishTo(s, EventCurrentPlace{3}) {
+		t.Error("published to unsubscribed")
+	}
+}
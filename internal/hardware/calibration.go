@@ -0,0 +1,54 @@
+package hardware
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Calibration - коэффициенты пересчёта показания места по двум точкам:
+// Value = Gain*Raw + Offset
+type Calibration struct {
+	Offset, Gain float64
+}
+
+// NewCalibration вычисляет коэффициенты по показаниям zero на нулевом газе и span на газе
+// с концентрацией concentration
+func NewCalibration(zero, span, concentration float64) (Calibration, error) {
+	if concentration <= 0 {
+		return Calibration{}, fmt.Errorf("концентрация газа должна быть больше нуля: %v", concentration)
+	}
+	if span == zero {
+		return Calibration{}, fmt.Errorf("показания на нулевом газе и газе %v совпадают: %v", concentration, zero)
+	}
+	gain := concentration / (span - zero)
+	return Calibration{Offset: -gain * zero, Gain: gain}, nil
+}
+
+func (x Calibration) Apply(raw float32) float32 {
+	return float32(x.Gain*float64(raw) + x.Offset)
+}
+
+// calibrations - коэффициенты мест, общие для Provider и сеансов опроса
+type calibrations struct {
+	mu sync.Mutex
+	m  map[int]Calibration
+}
+
+func (x *calibrations) set(m map[int]Calibration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.m = m
+}
+
+// apply пересчитывает значение показания по коэффициентам места, сохраняя исходное в Raw
+func (x *calibrations) apply(r *Reading) {
+	r.Raw = r.Value
+	if r.Error != nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if c, f := x.m[r.Pin]; f {
+		r.Value = c.Apply(r.Raw)
+	}
+}
@@ -0,0 +1,48 @@
+package hardware
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestCalibration(t *testing.T) {
+	c, err := NewCalibration(0.2, 2.2, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ raw, want float32 }{
+		{0.2, 0},
+		{2.2, 50},
+		{1.2, 25},
+	} {
+		if got := c.Apply(v.raw); math.Abs(float64(got-v.want)) > 1e-4 {
+			t.Errorf("%v: %v, want %v", v.raw, got, v.want)
+		}
+	}
+
+	if _, err := NewCalibration(1, 1, 50); err == nil {
+		t.Error("equal zero and span")
+	}
+	if _, err := NewCalibration(0, 1, 0); err == nil {
+		t.Error("zero concentration")
+	}
+
+	var x calibrations
+	x.set(map[int]Calibration{1: c})
+	r := Reading{Pin: 1, Value: 2.2}
+	x.apply(&r)
+	if r.Raw != 2.2 || math.Abs(float64(r.Value-50)) > 1e-4 {
+		t.Errorf("%+v", r)
+	}
+	r = Reading{Pin: 2, Value: 2.2}
+	x.apply(&r)
+	if r.Raw != 2.2 || r.Value != 2.2 {
+		t.Errorf("place without calibration: %+v", r)
+	}
+	r = Reading{Pin: 1, Value: 2.2, Error: errors.New("статус 1")}
+	x.apply(&r)
+	if r.Value != 2.2 {
+		t.Errorf("failed reading: %+v", r)
+	}
+}
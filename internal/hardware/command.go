@@ -0,0 +1,89 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RegisterCommand - чтение или запись регистров устройства для диагностики стенда
+type RegisterCommand struct {
+	Addr  byte
+	Reg   uint16
+	Count uint16
+	// Format - формат значений: uint16, float или float-swap (младшее слово первым)
+	Format string
+	// Values - регистры для записи, nil - чтение Count регистров
+	Values []uint16
+}
+
+// ParseRegisterCommand проверяет параметры команды. write - значения для записи через запятую
+// в формате format, пустая строка - чтение count регистров
+func ParseRegisterCommand(addr, reg, count uint, format, write string) (x RegisterCommand, err error) {
+	if addr > 247 {
+		return x, fmt.Errorf("недопустимый адрес устройства: %d", addr)
+	}
+	if reg > 0xFFFF {
+		return x, fmt.Errorf("недопустимый регистр: %d", reg)
+	}
+	if format != "uint16" && format != "float" && format != "float-swap" {
+		return x, fmt.Errorf("недопустимый формат: %s", format)
+	}
+	x = RegisterCommand{Addr: byte(addr), Reg: uint16(reg), Format: format}
+	if write == "" {
+		if count == 0 || count > maxBlockRegisters {
+			return x, fmt.Errorf("количество регистров чтения должно быть от 1 до %d: %d", maxBlockRegisters, count)
+		}
+		x.Count = uint16(count)
+		return x, nil
+	}
+	for _, str := range strings.Split(write, ",") {
+		str = strings.TrimSpace(str)
+		if format == "uint16" {
+			v, err := strconv.ParseUint(str, 0, 16)
+			if err != nil {
+				return x, fmt.Errorf("недопустимое значение uint16: %s", str)
+			}
+			x.Values = append(x.Values, uint16(v))
+			continue
+		}
+		v, err := strconv.ParseFloat(str, 32)
+		if err != nil {
+			return x, fmt.Errorf("недопустимое значение float: %s", str)
+		}
+		x.Values = append(x.Values, Float32Registers(float32(v), format == "float-swap")...)
+	}
+	if len(x.Values) > maxWriteRegisters {
+		return x, fmt.Errorf("количество регистров записи больше %d: %d", maxWriteRegisters, len(x.Values))
+	}
+	return x, nil
+}
+
+// Run выполняет команду: считывает регистры или записывает значения - один регистр функцией 6,
+// несколько функцией 16. Возвращает прочитанные или записанные регистры
+func (x RegisterCommand) Run(ctx context.Context, port Transport) ([]uint16, error) {
+	switch len(x.Values) {
+	case 0:
+		return ReadRegisters(ctx, port, x.Addr, x.Reg, x.Count)
+	case 1:
+		return x.Values, WriteRegister(ctx, port, x.Addr, x.Reg, x.Values[0])
+	default:
+		return x.Values, WriteRegisters(ctx, port, x.Addr, x.Reg, x.Values)
+	}
+}
+
+// FormatRegisters возвращает строки регистров regs, начиная с Reg: номер, значение в hex и
+// в формате команды. Пара регистров float выводится одной строкой
+func (x RegisterCommand) FormatRegisters(regs []uint16) (lines []string) {
+	for i := 0; i < len(regs); i++ {
+		if x.Format != "uint16" && i+1 < len(regs) {
+			lines = append(lines, fmt.Sprintf("%5d: %04X %04X %v", int(x.Reg)+i, regs[i], regs[i+1],
+				RegistersFloat32(regs[i:], x.Format == "float-swap")))
+			i++
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%5d: %04X %d", int(x.Reg)+i, regs[i], regs[i]))
+	}
+	return
+}
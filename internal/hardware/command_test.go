@@ -0,0 +1,79 @@
+package hardware
+
+import (
+	"context"
+	"github.com/fpawel/ufo82/internal/hardware/simulator"
+	"reflect"
+	"testing"
+)
+
+func TestParseRegisterCommand(t *testing.T) {
+	for _, c := range []struct {
+		addr, reg, count uint
+		format, write    string
+		ok               bool
+	}{
+		{17, 4, 2, "float", "", true},
+		{248, 4, 2, "uint16", "", false},
+		{17, 0x10000, 1, "uint16", "", false},
+		{17, 4, 0, "uint16", "", false},
+		{17, 4, 126, "uint16", "", false},
+		{17, 4, 1, "double", "", false},
+		{17, 4, 0, "uint16", "1, 0x10", true},
+		{17, 4, 1, "uint16", "70000", false},
+		{17, 4, 1, "float", "1.5, x", false},
+	} {
+		_, err := ParseRegisterCommand(c.addr, c.reg, c.count, c.format, c.write)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	stand := simulator.New()
+	stand.SetStatus(6, 3)
+	stand.SetValue(6, 2.5)
+	var codes []byte
+	port := &Loopback{Handler: func(request []byte) []byte {
+		codes = append(codes, request[1])
+		return stand.Handle(request)
+	}}
+	port.Open()
+	ctx := context.Background()
+
+	run := func(addr, reg, count uint, format, write string) []uint16 {
+		cmd, err := ParseRegisterCommand(addr, reg, count, format, write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		regs, err := cmd.Run(ctx, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return regs
+	}
+
+	// место 6 - второе место устройства 16: регистры 6, 7, статус 8, регистр 9, значение 10
+	cmd := RegisterCommand{Reg: 8, Format: "float"}
+	if lines := cmd.FormatRegisters(run(16, 8, 4, "float", "")); !reflect.DeepEqual(lines, []string{
+		"    8: 0003 0000 2.75506e-40",
+		"   10: 4020 0000 2.5",
+	}) {
+		t.Errorf("%q", lines)
+	}
+
+	// одно значение записывается функцией 6, несколько - функцией 16
+	codes = nil
+	run(16, 9, 0, "uint16", "7")
+	run(16, 6, 0, "float-swap", "1.5")
+	if !reflect.DeepEqual(codes, []byte{6, 16}) {
+		t.Errorf("functions %v", codes)
+	}
+	if regs := stand.Place(6).Registers; RegistersFloat32(regs[:], true) != 1.5 || regs[3] != 7 {
+		t.Errorf("%v", regs)
+	}
+	if regs := run(16, 6, 4, "uint16", ""); RegistersFloat32(regs, true) != 1.5 || regs[2] != 3 || regs[3] != 7 {
+		t.Errorf("%v", regs)
+	}
+}
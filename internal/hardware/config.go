@@ -2,18 +2,107 @@ package hardware
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"time"
+)
+
+// Link - способ связи со стендом
+type Link string
+
+const (
+	LinkSerial     Link = "serial"
+	LinkTCP        Link = "tcp"
+	LinkRTUOverTCP Link = "rtu-tcp"
 )
 
 type Config struct {
+	Link           Link
 	SerialPortName string
-	CheckedPlaces  [10]bool
-	filename       string
+	// Host, Port - адрес преобразователя RS-485 - Ethernet для LinkTCP и LinkRTUOverTCP
+	Host string
+	Port int
+	Comm Comm
+	// Places - места стенда в порядке их номеров
+	Places []Place
+	// BlockRead - опрашивать все выбранные места устройства одним запросом
+	BlockRead bool
+	// CyclePeriod - период цикла опроса в миллисекундах, 0 - опрашивать без пауз
+	CyclePeriod int
+	// ReconnectDelay, ReconnectMaxDelay - начальная и наибольшая пауза перед попыткой
+	// переподключения после потери связи, мс. Пауза удваивается после каждой неудачной попытки
+	ReconnectDelay    int
+	ReconnectMaxDelay int
+	// TrafficLog - записывать кадры обмена со стендом в журнал
+	TrafficLog bool
+	// ScanAddrMin, ScanAddrMax - диапазон адресов устройств, опрашиваемых при поиске стенда
+	ScanAddrMin int
+	ScanAddrMax int
+	// Stabilization - условие установления показаний мест
+	Stabilization Stabilization
+	// StatusBits - флаги слова статуса мест
+	StatusBits []StatusBit
+	filename   string
+}
+
+// maxCyclePeriod - наибольший период цикла опроса и интервал опроса места, мс
+const maxCyclePeriod = 3600000
+
+// MaxPlaces - наибольшее количество мест стенда: по десять мест на каждый из 247 адресов modbus
+const MaxPlaces = 247 * 10
+
+// Place - место стенда
+type Place struct {
+	// Addr - адрес modbus устройства, которое обслуживает место
+	Addr byte
+	// Register - начало блока регистров места: статус Register+2, значение float32 Register+4
+	Register uint16
+	Checked  bool
+	// Interval - интервал опроса места в миллисекундах, 0 - в каждом цикле
+	Interval int
+	// ValueMin, ValueMax - пределы достоверного показания места
+	ValueMin float64
+	ValueMax float64
+}
+
+// пределы достоверного показания места по умолчанию
+const (
+	defaultValueMin = -1000
+	defaultValueMax = 1000
+)
+
+// Comm - параметры линии связи и обмена со стендом. Интервалы времени - в миллисекундах
+type Comm struct {
+	Baud int
+	// Parity - контроль чётности: "N", "E" или "O"
+	Parity   string
+	StopBits int
+	// ReadTimeout - время ожидания ответа
+	ReadTimeout int
+	// ReadByteTimeout - пауза между байтами, по которой определяется конец кадра ответа
+	ReadByteTimeout int
+	MaxAttemptsRead int
+	// RequestDelay - пауза перед каждым запросом
+	RequestDelay int
+}
+
+// LoadConfig считывает конфиг из файла. Если файл отсутствует или повреждён, сохраняет и
+// возвращает конфиг по умолчанию
+func LoadConfig(filename string) Config {
+	r, err := ReadConfig(filename)
+	if err != nil {
+		fmt.Println("кофиг железа:", err, filename)
+		r.Save()
+	}
+	return r
 }
 
-func loadConfig(filename string) Config {
+// ReadConfig считывает конфиг из файла, не изменяя файл. Если файл отсутствует или повреждён,
+// возвращает конфиг по умолчанию и ошибку
+func ReadConfig(filename string) (Config, error) {
 
 	r := Config{filename: filename}
 	// считать настройки приложения из сохранённого файла json
@@ -21,12 +110,79 @@ func loadConfig(filename string) Config {
 	if err == nil {
 		err = json.Unmarshal(b, &r)
 	}
+	if err == nil && len(r.Places) == 0 {
+		// конфиг предыдущей версии: десять мест, выбранность мест в CheckedPlaces
+		var prev struct {
+			CheckedPlaces [10]bool
+		}
+		err = json.Unmarshal(b, &prev)
+		r.Places = StandPlaces([]byte{17, 16}, 5)
+		for i := range r.Places {
+			r.Places[i].Checked = prev.CheckedPlaces[i]
+			r.Places[i].ValueMin = -math.MaxFloat64
+		}
+	}
+	if err == nil {
+		for i, p := range r.Places {
+			if p.ValueMin == 0 && p.ValueMax == 0 {
+				// конфиг предыдущей версии отбраковывал только показания больше 1000
+				r.Places[i].ValueMin, r.Places[i].ValueMax = -math.MaxFloat64, defaultValueMax
+			}
+		}
+		err = ValidatePlaces(r.Places)
+	}
+	if err == nil && (r.CyclePeriod < 0 || r.CyclePeriod > maxCyclePeriod) {
+		err = fmt.Errorf("недопустимый период опроса: %d", r.CyclePeriod)
+	}
+	if err == nil && r.ScanAddrMin == 0 && r.ScanAddrMax == 0 {
+		// конфиг предыдущей версии
+		r.ScanAddrMin, r.ScanAddrMax = defaultScanAddrMin, defaultScanAddrMax
+	}
+	if err == nil {
+		err = ValidateScanAddrs(r.ScanAddrMin, r.ScanAddrMax)
+	}
+	if err == nil {
+		err = r.Stabilization.Validate()
+	}
+	if err == nil && r.StatusBits == nil {
+		// конфиг предыдущей версии
+		r.StatusBits = defaultStatusBits()
+	}
+	if err == nil {
+		err = ValidateStatusBits(r.StatusBits)
+	}
+	if err == nil && r.Link == "" {
+		// конфиг предыдущей версии
+		r.Link = LinkSerial
+	}
+	if err == nil {
+		if errLink := r.Link.Validate(); errLink != nil {
+			fmt.Println("кофиг железа:", errLink, filename)
+			r.Link = LinkSerial
+		}
+	}
+	if err == nil && r.Port == 0 {
+		// конфиг предыдущей версии
+		r.Port = defaultPort
+	}
+	if err == nil && (r.Port < 0 || r.Port > 65535) {
+		fmt.Println("кофиг железа: недопустимый номер порта TCP:", r.Port, filename)
+		r.Port = defaultPort
+	}
+	if err == nil && r.Comm == (Comm{}) {
+		r.Comm = defaultComm()
+	}
+	if err == nil {
+		if errComm := r.Comm.Validate(); errComm != nil {
+			fmt.Println("кофиг железа:", errComm, filename)
+			r.Comm = defaultComm()
+		}
+	}
 	if err != nil {
-		fmt.Println("кофиг железа:", err, filename)
 		r = defaultConfig()
-		r.Save()
+		r.filename = filename
 	}
-	return r
+	return r, err
 }
 
 func (x Config) Save() {
@@ -49,13 +205,165 @@ func (x Config) Save() {
 
 func defaultConfig() Config {
 	return Config{
-		SerialPortName: "COM1",
+		Link:              LinkSerial,
+		SerialPortName:    "COM1",
+		Port:              defaultPort,
+		Comm:              defaultComm(),
+		Places:            StandPlaces([]byte{17, 16}, 5),
+		ReconnectDelay:    1000,
+		ReconnectMaxDelay: 60000,
+		ScanAddrMin:       defaultScanAddrMin,
+		ScanAddrMax:       defaultScanAddrMax,
+		StatusBits:        defaultStatusBits(),
+	}
+}
+
+// defaultPort - порт Modbus TCP по умолчанию
+const defaultPort = 502
+
+const (
+	defaultScanAddrMin = 1
+	defaultScanAddrMax = 32
+)
+
+// ValidateScanAddrs проверяет диапазон адресов поиска стенда
+func ValidateScanAddrs(addrMin, addrMax int) error {
+	if addrMin < 1 || addrMax > 247 || addrMin > addrMax {
+		return fmt.Errorf("диапазон адресов поиска должен быть в пределах от 1 до 247: %d - %d", addrMin, addrMax)
+	}
+	return nil
+}
+
+// StandPlaces возвращает места стенда, в котором каждое из устройств addrs обслуживает
+// placesPerSlave мест с блоками по шесть регистров
+func StandPlaces(addrs []byte, placesPerSlave int) (places []Place) {
+	for _, addr := range addrs {
+		for n := 0; n < placesPerSlave; n++ {
+			places = append(places, Place{
+				Addr:     addr,
+				Register: uint16(6 * n),
+				ValueMin: defaultValueMin,
+				ValueMax: defaultValueMax,
+			})
+		}
+	}
+	return
+}
+
+func ValidatePlaces(places []Place) error {
+	if len(places) == 0 {
+		return errors.New("не заданы места стенда")
+	}
+	if len(places) > MaxPlaces {
+		return fmt.Errorf("мест стенда больше %d: %d", MaxPlaces, len(places))
+	}
+	type key struct {
+		addr     byte
+		register uint16
+	}
+	m := make(map[key]int)
+	for i, p := range places {
+		if p.Addr == 0 || p.Addr > 247 {
+			return fmt.Errorf("место %d: недопустимый адрес modbus: %d", i+1, p.Addr)
+		}
+		if p.Register > 0xFFFF-5 {
+			return fmt.Errorf("место %d: недопустимый номер регистра: %d", i+1, p.Register)
+		}
+		if p.Interval < 0 || p.Interval > maxCyclePeriod {
+			return fmt.Errorf("место %d: интервал опроса должен быть от 0 до %d мс: %d", i+1, maxCyclePeriod, p.Interval)
+		}
+		if !(p.ValueMin < p.ValueMax) {
+			return fmt.Errorf("место %d: недопустимые пределы показания: от %v до %v", i+1, p.ValueMin, p.ValueMax)
+		}
+		k := key{p.Addr, p.Register}
+		if n, f := m[k]; f {
+			return fmt.Errorf("места %d и %d: совпадают адрес %d и регистр %d", n+1, i+1, p.Addr, p.Register)
+		}
+		m[k] = i
+	}
+	return nil
+}
+
+func defaultComm() Comm {
+	return Comm{
+		Baud:            9600,
+		Parity:          "N",
+		StopBits:        1,
+		ReadTimeout:     1000,
+		ReadByteTimeout: 50,
+		MaxAttemptsRead: 1,
+	}
+}
+
+func (x Comm) Validate() error {
+	switch x.Baud {
+	case 1200, 2400, 4800, 9600, 19200, 38400, 57600, 115200:
+	default:
+		return fmt.Errorf("недопустимая скорость обмена: %d", x.Baud)
+	}
+	switch x.Parity {
+	case "N", "E", "O":
+	default:
+		return fmt.Errorf("недопустимый контроль чётности: %q", x.Parity)
+	}
+	if x.StopBits != 1 && x.StopBits != 2 {
+		return fmt.Errorf("недопустимое количество стоп-битов: %d", x.StopBits)
+	}
+	if x.ReadTimeout < 10 || x.ReadTimeout > 10000 {
+		return fmt.Errorf("время ожидания ответа должно быть от 10 до 10000 мс: %d", x.ReadTimeout)
+	}
+	if x.ReadByteTimeout < 1 || x.ReadByteTimeout > 1000 {
+		return fmt.Errorf("пауза между байтами должна быть от 1 до 1000 мс: %d", x.ReadByteTimeout)
+	}
+	if x.ReadByteTimeout > x.ReadTimeout {
+		return fmt.Errorf("пауза между байтами %d мс больше времени ожидания ответа %d мс",
+			x.ReadByteTimeout, x.ReadTimeout)
+	}
+	if x.MaxAttemptsRead < 1 || x.MaxAttemptsRead > 10 {
+		return fmt.Errorf("количество попыток чтения должно быть от 1 до 10: %d", x.MaxAttemptsRead)
+	}
+	if x.RequestDelay < 0 || x.RequestDelay > 10000 {
+		return fmt.Errorf("пауза перед запросом должна быть от 0 до 10000 мс: %d", x.RequestDelay)
+	}
+	return nil
+}
+
+func (x Config) reconnectDelays() (delay, maxDelay time.Duration) {
+	delay, maxDelay = time.Second, time.Minute
+	if x.ReconnectDelay > 0 {
+		delay = millis(x.ReconnectDelay)
+	}
+	if x.ReconnectMaxDelay > 0 {
+		maxDelay = millis(x.ReconnectMaxDelay)
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	return
+}
+
+func millis(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func (x Link) Valid() bool {
+	switch x {
+	case LinkSerial, LinkTCP, LinkRTUOverTCP:
+		return true
+	}
+	return false
+}
+
+func (x Link) Validate() error {
+	if !x.Valid() {
+		return fmt.Errorf("неизвестный способ связи: %q", x)
 	}
+	return nil
 }
 
 func (x Config) CheckedPlaceExists() bool {
-	for i := 0; i < 10; i++ {
-		if x.CheckedPlaces[i] {
+	for _, p := range x.Places {
+		if p.Checked {
 			return true
 		}
 	}
@@ -0,0 +1,91 @@
+package hardware
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestCommValidate(t *testing.T) {
+	if err := defaultComm().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []func(*Comm){
+		func(x *Comm) { x.Baud = 9601 },
+		func(x *Comm) { x.Parity = "X" },
+		func(x *Comm) { x.StopBits = 3 },
+		func(x *Comm) { x.ReadTimeout = 0 },
+		func(x *Comm) { x.ReadByteTimeout = 2000 },
+		func(x *Comm) { x.MaxAttemptsRead = 0 },
+		func(x *Comm) { x.RequestDelay = -1 },
+	} {
+		c := defaultComm()
+		f(&c)
+		if c.Validate() == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+}
+
+func TestLoadConfigPreviousVersion(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	err := ioutil.WriteFile(filename, []byte(`{"SerialPortName": "COM5", "CheckedPlaces": [true]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := LoadConfig(filename)
+	if c.SerialPortName != "COM5" || c.Link != LinkSerial || c.Comm != defaultComm() ||
+		len(c.Places) != 10 || !c.Places[0].Checked || c.Places[1].Checked ||
+		c.Places[0].ValueMin != -math.MaxFloat64 || c.Places[0].ValueMax != 1000 || c.Port != 502 {
+		t.Fatalf("%+v", c)
+	}
+
+	// неизвестный способ связи заменяется связью через COM порт, остальные настройки сохраняются
+	err = ioutil.WriteFile(filename, []byte(`{"Link": "udp", "Host": "10.0.0.7", "SerialPortName": "COM5"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = LoadConfig(filename)
+	if c.Link != LinkSerial || c.Host != "10.0.0.7" || c.Port != 502 || c.SerialPortName != "COM5" {
+		t.Fatalf("%+v", c)
+	}
+
+	// места без пределов достоверности: прежде отбраковывались только показания больше 1000
+	err = ioutil.WriteFile(filename, []byte(`{"Places": [{"Addr": 1, "Register": 0}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = LoadConfig(filename)
+	if len(c.Places) != 1 || c.Places[0].ValueMin != -math.MaxFloat64 || c.Places[0].ValueMax != 1000 {
+		t.Fatalf("%+v", c.Places)
+	}
+}
+
+func TestReadConfigMissingFile(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	c, err := ReadConfig(filename)
+	if err == nil || c.Link != LinkSerial || c.Port != 502 {
+		t.Fatalf("%+v: %v", c, err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("файл конфига создан: %v", err)
+	}
+}
+
+func TestStandPlaces(t *testing.T) {
+	xs := StandPlaces([]byte{17, 16}, 5)
+	if len(xs) != 10 || xs[4] != (Place{Addr: 17, Register: 24, ValueMin: -1000, ValueMax: 1000}) ||
+		xs[5] != (Place{Addr: 16, Register: 0, ValueMin: -1000, ValueMax: 1000}) {
+		t.Fatalf("%+v", xs)
+	}
+	if err := ValidatePlaces(xs); err != nil {
+		t.Fatal(err)
+	}
+	xs[6] = xs[5]
+	if ValidatePlaces(xs) == nil {
+		t.Fatal("duplicate place: no error")
+	}
+}
@@ -0,0 +1,143 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/fpawel/guartutils/modbus"
+	"math"
+)
+
+// registersData - данные запроса чтения count регистров, начиная с reg
+func registersData(reg, count uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, reg)
+	binary.BigEndian.PutUint16(b[2:], count)
+	return b
+}
+
+// crc16 - контрольная сумма modbus RTU. Для кадра с верной контрольной суммой возвращает ноль
+func crc16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// appendCRC16 дописывает в конец кадра modbus RTU контрольную сумму
+func appendCRC16(b []byte) []byte {
+	crc := crc16(b)
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+// ReadRegisters считывает функцией 3 count регистров устройства addr, начиная с reg
+func ReadRegisters(ctx context.Context, port Transport, addr byte, reg, count uint16) ([]uint16, error) {
+	if count == 0 || count > maxBlockRegisters {
+		return nil, fmt.Errorf("количество регистров чтения должно быть от 1 до %d: %d", maxBlockRegisters, count)
+	}
+	request := modbus.Request{
+		Addr:                modbus.Addr(addr),
+		ProtocolCommandCode: 3,
+		Data:                registersData(reg, count),
+	}
+	bytes, err := fetchResponse(ctx, port, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) != 5+2*int(count) {
+		return nil, fmt.Errorf("длина ответа не %d: % X", 5+2*int(count), bytes)
+	}
+	values := make([]uint16, count)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(bytes[3+2*i:])
+	}
+	return values, nil
+}
+
+// WriteRegister записывает функцией 6 value в регистр reg устройства addr
+func WriteRegister(ctx context.Context, port Transport, addr byte, reg uint16, value uint16) error {
+	request := modbus.Request{
+		Addr:                modbus.Addr(addr),
+		ProtocolCommandCode: 6,
+		Data:                registersData(reg, value),
+	}
+	bytes, err := fetchResponse(ctx, port, request)
+	if err != nil {
+		return err
+	}
+	// ответ повторяет запрос
+	if len(bytes) != 8 || string(bytes[2:6]) != string(request.Data) {
+		return fmt.Errorf("ответ не подтверждает запись: % X", bytes)
+	}
+	return nil
+}
+
+// WriteRegisters записывает функцией 16 values в регистры устройства addr, начиная с reg
+func WriteRegisters(ctx context.Context, port Transport, addr byte, reg uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > maxWriteRegisters {
+		return fmt.Errorf("количество регистров записи должно быть от 1 до %d: %d", maxWriteRegisters, len(values))
+	}
+	data := append(registersData(reg, uint16(len(values))), byte(2*len(values)))
+	for _, v := range values {
+		data = append(data, byte(v>>8), byte(v))
+	}
+	request := modbus.Request{
+		Addr:                modbus.Addr(addr),
+		ProtocolCommandCode: 16,
+		Data:                data,
+	}
+	bytes, err := fetchResponse(ctx, port, request)
+	if err != nil {
+		return err
+	}
+	// ответ повторяет начальный регистр и количество записанных регистров
+	if len(bytes) != 8 || string(bytes[2:6]) != string(data[:4]) {
+		return fmt.Errorf("ответ не подтверждает запись: % X", bytes)
+	}
+	return nil
+}
+
+// maxWriteRegisters - наибольшее количество регистров в одном запросе функции 16
+const maxWriteRegisters = 123
+
+// fetchResponse выполняет запрос и проверяет ответ. Ответ с исключением modbus возвращается как ошибка
+func fetchResponse(ctx context.Context, port Transport, request modbus.Request) ([]byte, error) {
+	bytes, err := port.Fetch(ctx, request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if code, f := exceptionCode(bytes); f {
+		return nil, fmt.Errorf("% X: исключение modbus %d", bytes, code)
+	}
+	if err := request.CheckResponse(bytes); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// Float32Registers - значение v в двух регистрах. swapWords - младшее слово в первом регистре
+func Float32Registers(v float32, swapWords bool) []uint16 {
+	n := math.Float32bits(v)
+	if swapWords {
+		return []uint16{uint16(n), uint16(n >> 16)}
+	}
+	return []uint16{uint16(n >> 16), uint16(n)}
+}
+
+// RegistersFloat32 - значение float32, записанное в двух регистрах regs. swapWords - младшее слово в
+// первом регистре
+func RegistersFloat32(regs []uint16, swapWords bool) float32 {
+	hi, lo := regs[0], regs[1]
+	if swapWords {
+		hi, lo = lo, hi
+	}
+	return math.Float32frombits(uint32(hi)<<16 | uint32(lo))
+}
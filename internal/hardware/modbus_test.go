@@ -0,0 +1,53 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/fpawel/ufo82/internal/hardware/simulator"
+	"reflect"
+	"testing"
+)
+
+func TestReadRegisters(t *testing.T) {
+	stand := simulator.New()
+	stand.SetStatus(6, 3)
+	stand.SetValue(6, 2.5)
+	port := &Loopback{Handler: stand.Handle}
+	port.Open()
+	ctx := context.Background()
+
+	regs, err := ReadRegisters(ctx, port, 16, 8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs[0] != 3 || RegistersFloat32(regs[2:], false) != 2.5 {
+		t.Fatalf("%v", regs)
+	}
+	if _, err := ReadRegisters(ctx, port, 16, 28, 4); err == nil {
+		t.Fatal("no exception")
+	}
+}
+
+func TestWriteRegisters(t *testing.T) {
+	var got []uint16
+	port := &Loopback{Handler: func(request []byte) []byte {
+		n := int(binary.BigEndian.Uint16(request[4:]))
+		got = nil
+		for i := 0; i < n; i++ {
+			got = append(got, binary.BigEndian.Uint16(request[7+2*i:]))
+		}
+		return appendCRC16(append([]byte(nil), request[:6]...))
+	}}
+	port.Open()
+
+	values := append([]uint16{7}, Float32Registers(1.5, true)...)
+	if err := WriteRegisters(context.Background(), port, 1, 10, values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) || RegistersFloat32(got[1:], true) != 1.5 {
+		t.Fatalf("%v", got)
+	}
+	if err := WriteRegisters(context.Background(), port, 1, 10, nil); err == nil {
+		t.Fatal("no error for empty write")
+	}
+}
@@ -0,0 +1,172 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// netTransport - связь со стендом через преобразователь RS-485 - Ethernet.
+// Если mbap, кадры RTU преобразуются в кадры Modbus TCP, иначе передаются как есть
+type netTransport struct {
+	address         string
+	mbap            bool
+	dialTimeout     time.Duration
+	readTimeout     time.Duration
+	readByteTimeout time.Duration
+	maxAttemptsRead int
+	conn            net.Conn
+	transactionID   uint16
+}
+
+func newNetTransport(cfg Config) Transport {
+	return &netTransport{
+		address:         net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		mbap:            cfg.Link == LinkTCP,
+		dialTimeout:     5 * time.Second,
+		readTimeout:     millis(cfg.Comm.ReadTimeout),
+		readByteTimeout: millis(cfg.Comm.ReadByteTimeout),
+		maxAttemptsRead: cfg.Comm.MaxAttemptsRead,
+	}
+}
+
+func (x *netTransport) Open() (err error) {
+	x.conn, err = net.DialTimeout("tcp", x.address, x.dialTimeout)
+	return
+}
+
+func (x *netTransport) Close() error {
+	if x.conn == nil {
+		return nil
+	}
+	err := x.conn.Close()
+	x.conn = nil
+	return err
+}
+
+func (x *netTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	if x.conn == nil {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// отмена ctx прерывает ожидание ответа истёкшим сроком чтения
+	conn, fetched := x.conn, make(chan struct{})
+	defer close(fetched)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Unix(1, 0))
+		case <-fetched:
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		var response []byte
+		var err error
+		if x.mbap {
+			response, err = x.fetchMBAP(request)
+		} else {
+			response, err = x.fetchRTU(request)
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != ErrTimeout || attempt >= x.maxAttemptsRead {
+			return response, err
+		}
+	}
+}
+
+func (x *netTransport) fetchRTU(request []byte) ([]byte, error) {
+	if _, err := x.conn.Write(request); err != nil {
+		return nil, err
+	}
+	var response []byte
+	b := make([]byte, 256)
+	timeout := x.readTimeout
+	for {
+		if err := x.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		n, err := x.conn.Read(b)
+		response = append(response, b[:n]...)
+		if isTimeout(err) {
+			if len(response) == 0 {
+				return nil, ErrTimeout
+			}
+			return response, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// конец кадра - пауза между байтами больше readByteTimeout
+		timeout = x.readByteTimeout
+	}
+}
+
+func (x *netTransport) fetchMBAP(request []byte) ([]byte, error) {
+	if len(request) < 4 {
+		return nil, fmt.Errorf("% X: короткий кадр запроса", request)
+	}
+	// PDU без адреса и контрольной суммы
+	pdu := request[1 : len(request)-2]
+	x.transactionID++
+
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame, x.transactionID)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = request[0]
+	frame = append(frame, pdu...)
+	if _, err := x.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	if err := x.conn.SetReadDeadline(time.Now().Add(x.readTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(x.conn, header); err != nil {
+			if isTimeout(err) {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length > 254 {
+			return nil, fmt.Errorf("% X: длина кадра MBAP %d", header, length)
+		}
+		body := make([]byte, length-1)
+		if _, err := io.ReadFull(x.conn, body); err != nil {
+			if isTimeout(err) {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		// ответ на один из предыдущих запросов, пришедший после таймаута
+		if binary.BigEndian.Uint16(header) != x.transactionID {
+			continue
+		}
+		return appendCRC16(append([]byte{header[6]}, body...)), nil
+	}
+}
+
+func isTimeout(err error) bool {
+	e, ok := errors.Cause(err).(net.Error)
+	return ok && e.Timeout()
+}
+
+func netConnectionFailed(err error) bool {
+	err = errors.Cause(err)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok && !isTimeout(err)
+}
@@ -0,0 +1,96 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/fpawel/ufo82/internal/hardware/simulator"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// serveMBAP обслуживает кадры Modbus TCP, передавая их стенду как кадры RTU
+func serveMBAP(conn net.Conn, stand *simulator.Stand) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		r := stand.Handle(appendCRC16(append([]byte{header[6]}, pdu...)))
+		if r == nil {
+			continue
+		}
+		r = r[1 : len(r)-2]
+		binary.BigEndian.PutUint16(header[4:], uint16(len(r)+1))
+		if _, err := conn.Write(append(header, r...)); err != nil {
+			return
+		}
+	}
+}
+
+func listen(t *testing.T, serve func(net.Conn)) (net.Listener, Config) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	cfg := defaultConfig()
+	cfg.Host = host
+	cfg.Port, _ = strconv.Atoi(port)
+	cfg.Comm.ReadTimeout = 100
+	return ln, cfg
+}
+
+func testNetTransport(t *testing.T, link Link, serve func(net.Conn, *simulator.Stand)) {
+	stand := simulator.New()
+	stand.SetValue(6, 3.5)
+	ln, cfg := listen(t, func(conn net.Conn) {
+		serve(conn, stand)
+	})
+	defer ln.Close()
+	cfg.Link = link
+
+	port := ConfigTransport(cfg)
+	if err := port.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	ctx := context.Background()
+	if r := readPin(ctx, port, cfg, 6); r.Error != nil || r.Value != 3.5 {
+		t.Fatalf("%+v", r)
+	}
+
+	stand.SetFault(6, simulator.FaultTimeout)
+	if r := readPin(ctx, port, cfg, 6); r.Error != ErrTimeout {
+		t.Fatalf("%+v", r)
+	}
+}
+
+func TestModbusTCP(t *testing.T) {
+	testNetTransport(t, LinkTCP, func(conn net.Conn, stand *simulator.Stand) {
+		serveMBAP(conn, stand)
+	})
+}
+
+func TestRTUOverTCP(t *testing.T) {
+	testNetTransport(t, LinkRTUOverTCP, func(conn net.Conn, stand *simulator.Stand) {
+		defer conn.Close()
+		stand.Serve(conn)
+	})
+}
@@ -0,0 +1,76 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+)
+
+// ProbeResult - адреса устройств, ответивших на пробный запрос через порт Port.
+// Для связи через преобразователь RS-485 - Ethernet Port - его адрес
+type ProbeResult struct {
+	Port  string
+	Addrs []byte
+}
+
+// probeRequest - запрос поиска стенда. auto - поиск начат из-за пропажи выбранного COM порта
+type probeRequest struct {
+	addrMin, addrMax int
+	auto             bool
+}
+
+type probeOutcome struct {
+	probeRequest
+	ports   []string
+	results []ProbeResult
+}
+
+// probe через каждый из ports опрашивает устройства с адресами из диапазона r чтением регистров
+// первого места - как устройства стенда УФО-82. Возвращает порты, через которые ответило
+// хотя бы одно устройство
+func (x Provider) probe(ctx context.Context, cfg Config, ports []string, r probeRequest) (results []ProbeResult) {
+	cfg.Comm.MaxAttemptsRead = 1
+	for _, name := range ports {
+		if cfg.Link == LinkSerial {
+			cfg.SerialPortName = name
+		}
+		port := trafficTransport{x.newTransport(cfg), x.traffic}
+		if err := port.Open(); err != nil {
+			fmt.Println("поиск стенда:", name, err)
+			continue
+		}
+		result := ProbeResult{Port: name}
+		for addr := r.addrMin; addr <= r.addrMax && ctx.Err() == nil; addr++ {
+			if _, err := ReadRegisters(ctx, port, byte(addr), 0, 6); err == nil {
+				result.Addrs = append(result.Addrs, byte(addr))
+			}
+		}
+		if err := port.Close(); err != nil {
+			fmt.Println("поиск стенда:", name, err)
+		}
+		if len(result.Addrs) > 0 {
+			results = append(results, result)
+		}
+	}
+	return
+}
+
+// bestProbePort возвращает порт, через который ответило больше всего устройств мест стенда places
+func bestProbePort(results []ProbeResult, places []Place) (string, bool) {
+	addrs := make(map[byte]bool)
+	for _, p := range places {
+		addrs[p.Addr] = true
+	}
+	best, bestCount := "", 0
+	for _, r := range results {
+		count := 0
+		for _, addr := range r.Addrs {
+			if addrs[addr] {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = r.Port, count
+		}
+	}
+	return best, bestCount > 0
+}
@@ -0,0 +1,18 @@
+package hardware
+
+import "testing"
+
+func TestBestProbePort(t *testing.T) {
+	places := StandPlaces([]byte{17, 16}, 5)
+	results := []ProbeResult{
+		{Port: "COM1", Addrs: []byte{1, 2, 3}},
+		{Port: "COM3", Addrs: []byte{17}},
+		{Port: "COM4", Addrs: []byte{16, 17}},
+	}
+	if port, found := bestProbePort(results, places); !found || port != "COM4" {
+		t.Fatalf("%q %v", port, found)
+	}
+	if _, found := bestProbePort(results[:1], places); found {
+		t.Fatal("port without stand devices")
+	}
+}
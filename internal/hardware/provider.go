@@ -1,14 +1,17 @@
 package hardware
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/fpawel/guartutils/comport"
-	"github.com/fpawel/guartutils/fetch"
 	"github.com/fpawel/guartutils/modbus"
 	"github.com/pkg/errors"
-	"github.com/tarm/serial"
 	"math"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,29 +19,88 @@ type Peer interface {
 	HardwareConnected()
 	HardwareDisconnected()
 	HardwareConnectionError(string)
+	// HardwareReconnect - связь потеряна, попытка переподключения attempt через delay
+	HardwareReconnect(attempt int, delay time.Duration)
+	// HardwareReconnected - связь восстановлена, опрос продолжается
+	HardwareReconnected()
 	HardwareReading(s Reading)
 	HardwareConfig(config Config)
 	HardwareCurrentPlace(int)
 	ComPorts([]string)
+	// HardwareProbe - результат поиска стенда: порты, через которые ответили устройства
+	HardwareProbe([]ProbeResult)
+	// HardwareWrite - результат записи регистров места
+	HardwareWrite(RegisterWrite)
+	// HardwareStable - показание места установилось
+	HardwareStable(Reading)
 }
 
 type Reading struct {
 	Pin    int
 	Status uint16
-	Value  float32
+	// Flags - названия установленных флагов слова статуса
+	Flags []string
+	// Value - показание места, пересчитанное по коэффициентам калибровки, если они заданы
+	Value float32
+	// Raw - показание места до пересчёта
+	Raw float32
+	// Stable - показание установилось по условию Config.Stabilization
+	Stable bool
 	Error  error
+	// Time - время начала цикла опроса, в котором получено значение
+	Time time.Time
 }
 
+var (
+	ErrStarted        = errors.New("опрос уже выполняется")
+	ErrProviderClosed = errors.New("оборудование закрыто")
+	ErrProbing        = errors.New("выполняется поиск стенда")
+)
+
 type Provider struct {
-	peer                           Peer
-	chStart, chStop, chComportDone chan struct{}
-	comports,
-	interrupt, done chan bool
-	setPinChecked                chan pinChecked
-	setPortName                  chan string
-	chGetPinChecked              chan pinCheckedR
-	chChanInterruptComport       chan chan struct{}
-	chChanCurrentWorkInterrupted chan chan bool
+	peer             Peer
+	newTransport     NewTransport
+	chStart          chan startRequest
+	chGetSession     chan chan *Session
+	chClose          chan struct{}
+	closeOnce        *sync.Once
+	done             chan struct{}
+	comports         chan bool
+	setPinChecked    chan pinChecked
+	setPortName      chan string
+	setLink          chan Link
+	setNetAddress    chan netAddress
+	setComm          chan Comm
+	setPlaces        chan []Place
+	setBlockRead     chan bool
+	setCyclePeriod   chan int
+	setTrafficLog    chan bool
+	setStabilization chan Stabilization
+	setStatusBits    chan []StatusBit
+	chScan           chan probeRequest
+	probeDone        chan probeOutcome
+	chWrite          chan RegisterWrite
+	chGetConfig      chan chan Config
+	traffic          *trafficLog
+	calibrations     *calibrations
+}
+
+// Session - сеанс опроса стенда от Start до остановки или потери связи
+type Session struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	writes chan RegisterWrite
+}
+
+type startRequest struct {
+	ctx context.Context
+	ch  chan startResult
+}
+
+type startResult struct {
+	session *Session
+	err     error
 }
 
 type pinChecked struct {
@@ -46,126 +108,243 @@ type pinChecked struct {
 	pin     int
 }
 
-type pinCheckedR struct {
-	ch  chan checkedR
-	pin int
+type netAddress struct {
+	host string
+	port int
 }
 
-type checkedR struct {
-	checked    bool
-	hasChecked bool
+func NewProvider(peer Peer, configFilename string) Provider {
+	return NewProviderTransport(peer, configFilename, ConfigTransport)
 }
 
-func NewProvider(peer Peer, configFilename string) Provider {
+// NewProviderTransport создаёт Provider, связывающийся со стендом через канал, созданный newTransport
+func NewProviderTransport(peer Peer, configFilename string, newTransport NewTransport) Provider {
 
 	x := Provider{
-		peer:                         peer,
-		chStart:                      make(chan struct{}),
-		chStop:                       make(chan struct{}),
-		chComportDone:                make(chan struct{}),
-		comports:                     make(chan bool),
-		setPinChecked:                make(chan pinChecked),
-		setPortName:                  make(chan string),
-		done:                         make(chan bool),
-		interrupt:                    make(chan bool, 3),
-		chGetPinChecked:              make(chan pinCheckedR),
-		chChanInterruptComport:       make(chan chan struct{}),
-		chChanCurrentWorkInterrupted: make(chan chan bool),
+		peer:             peer,
+		newTransport:     newTransport,
+		chStart:          make(chan startRequest),
+		chGetSession:     make(chan chan *Session),
+		chClose:          make(chan struct{}),
+		closeOnce:        new(sync.Once),
+		done:             make(chan struct{}),
+		comports:         make(chan bool),
+		setPinChecked:    make(chan pinChecked),
+		setPortName:      make(chan string),
+		setLink:          make(chan Link),
+		setNetAddress:    make(chan netAddress),
+		setComm:          make(chan Comm),
+		setPlaces:        make(chan []Place),
+		setBlockRead:     make(chan bool),
+		setCyclePeriod:   make(chan int),
+		setTrafficLog:    make(chan bool),
+		setStabilization: make(chan Stabilization),
+		setStatusBits:    make(chan []StatusBit),
+		chScan:           make(chan probeRequest),
+		probeDone:        make(chan probeOutcome),
+		chWrite:          make(chan RegisterWrite),
+		chGetConfig:      make(chan chan Config),
+		calibrations:     new(calibrations),
+		traffic:          newTrafficLog(filepath.Join(filepath.Dir(configFilename), "traffic")),
 	}
 	go x.run(configFilename)
 	go comport.NotifyAvailablePortsChange(x.comports)
 	return x
 }
 
-func (x Provider) getPinChecked(pin int) checkedR {
-	ch := make(chan checkedR)
-	x.chGetPinChecked <- pinCheckedR{ch, pin}
-	return <-ch
+// Config возвращает текущий конфиг оборудования, после закрытия - нулевой конфиг
+func (x Provider) Config() Config {
+	ch := make(chan Config)
+	select {
+	case x.chGetConfig <- ch:
+		return <-ch
+	case <-x.done:
+		return Config{}
+	}
 }
 
-func (x Provider) runComPort(serialPortName string) {
-	defer func() {
-		x.chComportDone <- struct{}{}
-	}()
+// runComPort опрашивает стенд до отмены ctx или ошибки, при которой опрос невозможен
+func (x Provider) runComPort(ctx context.Context, cfg Config, writes <-chan RegisterWrite) error {
 
-	port := comport.NewPort(comport.Config{
-		Serial: serial.Config{
-			ReadTimeout: time.Millisecond,
-			Baud:        9600,
-			Name:        serialPortName,
-		},
-		Fetch: fetch.Config{
-			MaxAttemptsRead: 1,
-			ReadTimeout:     time.Second,
-			ReadByteTimeout: 50 * time.Millisecond,
-		},
-	})
+	port := withRequestDelay(trafficTransport{x.newTransport(cfg), x.traffic}, millis(cfg.Comm.RequestDelay))
 
 	if err := port.Open(); err != nil {
 		x.peer.HardwareConnectionError(err.Error())
-		return
+		return err
 	}
 	x.peer.HardwareConnected()
 
+	opened := true
 	defer func() {
 		x.peer.HardwareDisconnected()
+		if !opened {
+			return
+		}
 		if err := port.Close(); err != nil {
 			x.peer.HardwareConnectionError(err.Error())
 		}
 	}()
+	// устройства, отвергающие чтение блока регистров всех мест
+	rejectBlock := make(map[byte]bool)
+	sched := newScheduler(time.Now())
+	stab := newStabilizer()
 	for {
-		for pin := 0; pin < 10; pin++ {
-			c := x.getPinChecked(pin)
-			if !c.hasChecked {
-				x.peer.HardwareConnectionError("не выбраны места")
-				return
+		cfg := x.Config()
+		if !cfg.CheckedPlaceExists() {
+			err := errors.New("не выбраны места")
+			x.peer.HardwareConnectionError(err.Error())
+			return err
+		}
+		t := sched.nextCycle(time.Now(), millis(cfg.CyclePeriod))
+		if cfg.CyclePeriod <= 0 {
+			// без периода цикл начинается, когда наступит срок опроса хотя бы одного места
+			t = sched.firstDue(t, cfg.Places)
+		}
+		err := x.waitCycle(ctx, port, cfg.Places, t, writes)
+		if err == nil {
+			// в цикле опрашиваются только места, срок опроса которых наступил
+			for i, p := range cfg.Places {
+				cfg.Places[i].Checked = p.Checked && sched.placeDue(i, millis(p.Interval), t)
 			}
-			if !c.checked {
-				continue
+			err = x.pollCycle(ctx, port, cfg, t, rejectBlock, stab)
+		}
+		if connectionFailed(err) {
+			x.peer.HardwareConnectionError(err.Error())
+			if err := x.reconnect(ctx, port, cfg); err != nil {
+				opened = false
+				return err
 			}
-			x.peer.HardwareCurrentPlace(pin)
-			reading := x.readPin(port, pin)
-			x.peer.HardwareCurrentPlace(-1)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pollCycle опрашивает выбранные места цикла, начавшегося в t. Возвращает ошибку связи или отмены ctx
+func (x Provider) pollCycle(ctx context.Context, port Transport, cfg Config, t time.Time, rejectBlock map[byte]bool, stab *stabilizer) error {
+	for _, p := range makePolls(cfg, rejectBlock) {
+		x.peer.HardwareCurrentPlace(p.pins[0])
+		readings := poll(ctx, port, cfg, p, rejectBlock)
+		x.peer.HardwareCurrentPlace(-1)
+		for _, reading := range readings {
+			reading.Time = t
+			x.calibrations.apply(&reading)
+			stable, settled := stab.add(cfg.Stabilization, reading)
+			reading.Stable = stable
 			x.peer.HardwareReading(reading)
-			err := reading.Error
-			if fetch.ConnectionFailed(err) {
-				x.peer.HardwareConnectionError(err.Error())
-				return
-			}
-			if fetch.Canceled(err) || x.CurrentWorkInterrupted() {
-				return
+			if settled {
+				x.peer.HardwareStable(reading)
 			}
 		}
+		if err := readings[len(readings)-1].Error; connectionFailed(err) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (x Provider) CurrentWorkInterrupted() bool {
-	ch := make(chan bool)
-	x.chChanCurrentWorkInterrupted <- ch
-	return <-ch
+// reconnect закрывает port и открывает его снова с нарастающими паузами между попытками
+// до успешного открытия или отмены ctx
+func (x Provider) reconnect(ctx context.Context, port Transport, cfg Config) error {
+	if err := port.Close(); err != nil {
+		x.peer.HardwareConnectionError(err.Error())
+	}
+	delay, maxDelay := cfg.reconnectDelays()
+	for attempt := 1; ; attempt++ {
+		x.peer.HardwareReconnect(attempt, delay)
+		if err := waitUntil(ctx, time.Now().Add(delay)); err != nil {
+			return err
+		}
+		err := port.Open()
+		if err == nil {
+			x.peer.HardwareReconnected()
+			return nil
+		}
+		x.peer.HardwareConnectionError(err.Error())
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// waitUntil ожидает наступления момента t. Возвращает ошибку ctx, если ожидание прервано
+func waitUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (x Provider) SubscribeInterrupted(ch chan struct{}, subscribe bool) {
-	if subscribe {
-		x.chChanInterruptComport <- ch
-	} else {
-		x.chChanInterruptComport <- nil
+// Start начинает сеанс опроса стенда. Опрос прекращается при отмене ctx,
+// остановке сеанса или ошибке, при которой опрос невозможен
+func (x Provider) Start(ctx context.Context) (*Session, error) {
+	ch := make(chan startResult)
+	select {
+	case x.chStart <- startRequest{ctx, ch}:
+		r := <-ch
+		return r.session, r.err
+	case <-x.done:
+		return nil, ErrProviderClosed
 	}
+}
 
+// Stop останавливает текущий сеанс опроса, если он есть, и ожидает его завершения не дольше срока ctx
+func (x Provider) Stop(ctx context.Context) error {
+	ch := make(chan *Session)
+	select {
+	case x.chGetSession <- ch:
+	case <-x.done:
+		return nil
+	}
+	if s := <-ch; s != nil {
+		return s.Stop(ctx)
+	}
+	return nil
 }
 
+// Close останавливает опрос и ожидает его завершения. Повторные вызовы ничего не делают
 func (x Provider) Close() error {
-	x.interrupt <- true
+	x.closeOnce.Do(func() {
+		close(x.chClose)
+	})
 	<-x.done
 	return nil
 }
 
-func (x Provider) Start() {
-	x.chStart <- struct{}{}
+// Stop прерывает опрос и ожидает его завершения не дольше срока ctx
+func (x *Session) Stop(ctx context.Context) error {
+	x.cancel()
+	select {
+	case <-x.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done закрывается по завершении опроса
+func (x *Session) Done() <-chan struct{} {
+	return x.done
 }
 
-func (x Provider) Stop() {
-	x.chStop <- struct{}{}
+// Err возвращает причину завершения опроса после закрытия Done: context.Canceled при остановке
+// или ошибку, при которой опрос невозможен
+func (x *Session) Err() error {
+	select {
+	case <-x.done:
+		return x.err
+	default:
+		return nil
+	}
 }
 
 func (x Provider) SetChecked(pin int, checked bool) {
@@ -181,47 +360,246 @@ func (x Provider) SetPortName(portName string) {
 	}()
 }
 
+func (x Provider) SetLink(link Link) {
+	go func() {
+		x.setLink <- link
+	}()
+}
+
+func (x Provider) SetNetAddress(host string, port int) {
+	go func() {
+		x.setNetAddress <- netAddress{host, port}
+	}()
+}
+
+// SetPlaces задаёт раскладку мест стенда
+func (x Provider) SetPlaces(places []Place) {
+	go func() {
+		x.setPlaces <- places
+	}()
+}
+
+// SetTrafficLog включает или выключает запись обмена со стендом в журнал
+func (x Provider) SetTrafficLog(enabled bool) {
+	go func() {
+		x.setTrafficLog <- enabled
+	}()
+}
+
+// Scan начинает поиск стенда: опрашивает устройства с адресами от addrMin до addrMax через
+// каждый доступный COM порт или через преобразователь RS-485 - Ethernet. Результат передаётся
+// HardwareProbe, порт, через который отвечают устройства стенда, выбирается в конфиге
+func (x Provider) Scan(addrMin, addrMax int) {
+	go func() {
+		x.chScan <- probeRequest{addrMin: addrMin, addrMax: addrMax}
+	}()
+}
+
+// Write записывает values в регистры места pin, начиная с регистра с номером offset относительно
+// начала блока регистров места. Запись выполняется в сеансе опроса перед очередным циклом,
+// результат передаётся HardwareWrite
+func (x Provider) Write(pin int, offset uint16, values []uint16) {
+	go func() {
+		x.chWrite <- RegisterWrite{Pin: pin, Offset: offset, Values: values}
+	}()
+}
+
+// SetCalibrations задаёт коэффициенты калибровки мест по их номерам. Показания мест без
+// коэффициентов не пересчитываются
+func (x Provider) SetCalibrations(m map[int]Calibration) {
+	x.calibrations.set(m)
+}
+
+// SetStabilization задаёт условие установления показаний мест
+func (x Provider) SetStabilization(s Stabilization) {
+	go func() {
+		x.setStabilization <- s
+	}()
+}
+
+// SetStatusBits задаёт флаги слова статуса мест
+func (x Provider) SetStatusBits(bits []StatusBit) {
+	go func() {
+		x.setStatusBits <- bits
+	}()
+}
+
+func (x Provider) SetBlockRead(blockRead bool) {
+	go func() {
+		x.setBlockRead <- blockRead
+	}()
+}
+
+// SetCyclePeriod задаёт период цикла опроса в миллисекундах, 0 - опрашивать без пауз
+func (x Provider) SetCyclePeriod(period int) {
+	go func() {
+		x.setCyclePeriod <- period
+	}()
+}
+
+func (x Provider) SetComm(comm Comm) {
+	go func() {
+		x.setComm <- comm
+	}()
+}
+
 func (x Provider) run(configFilename string) {
 
-	cfg := loadConfig(configFilename)
+	cfg := LoadConfig(configFilename)
 	x.peer.HardwareConfig(cfg)
-	started := false
-	currentWorkInterrupted := false
-	waitComport := false
+	x.traffic.setEnabled(cfg.TrafficLog)
+	defer close(x.done)
 	defer func() {
-		x.done <- true
+		if err := x.traffic.Close(); err != nil {
+			fmt.Println("журнал обмена:", err)
+		}
 	}()
 
-	var interruptComport chan struct{}
+	var session *Session
+	// sessionDone - канал завершения текущего сеанса, nil, если опрос не выполняется
+	var sessionDone <-chan struct{}
+	// probeCancel прерывает поиск стенда, nil, если поиск не выполняется
+	var probeCancel context.CancelFunc
+	chClose := x.chClose
+	closing := false
+
+	startProbe := func(r probeRequest, ports []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		probeCancel = cancel
+		go func(cfg Config) {
+			results := x.probe(ctx, cfg, ports, r)
+			cancel()
+			x.probeDone <- probeOutcome{r, ports, results}
+		}(cfg)
+	}
 
-gotoSelect:
 	for {
 
 		select {
 
-		case ch := <-x.chChanCurrentWorkInterrupted:
-			ch <- currentWorkInterrupted
+		case ch := <-x.chGetConfig:
+			c := cfg
+			c.Places = append([]Place(nil), cfg.Places...)
+			c.StatusBits = append([]StatusBit(nil), cfg.StatusBits...)
+			ch <- c
 
-		case c := <-x.chGetPinChecked:
+		case ch := <-x.chGetSession:
+			ch <- session
 
-			c.ch <- checkedR{
-				checked:    cfg.CheckedPlaces[c.pin],
-				hasChecked: cfg.CheckedPlaceExists(),
+		case r := <-x.chStart:
+			if closing {
+				r.ch <- startResult{err: ErrProviderClosed}
+				continue
+			}
+			if session != nil {
+				select {
+				case <-session.done:
+					// сеанс завершён, но его завершение ещё не обработано
+					session, sessionDone = nil, nil
+				default:
+					r.ch <- startResult{err: ErrStarted}
+					continue
+				}
+			}
+			if probeCancel != nil {
+				r.ch <- startResult{err: ErrProbing}
+				continue
+			}
+			ctx, cancel := context.WithCancel(r.ctx)
+			s := &Session{cancel: cancel, done: make(chan struct{}), writes: make(chan RegisterWrite, maxPendingWrites)}
+			session, sessionDone = s, s.done
+			go func(cfg Config) {
+				s.err = x.runComPort(ctx, cfg, s.writes)
+				cancel()
+				close(s.done)
+			}(cfg)
+			r.ch <- startResult{session: s}
+
+		case <-sessionDone:
+			session, sessionDone = nil, nil
+			if closing && probeCancel == nil {
+				return
 			}
 
-		case ch := <-x.chChanInterruptComport:
-			interruptComport = ch
+		case <-chClose:
+			chClose = nil
+			if session == nil && probeCancel == nil {
+				return
+			}
+			// дождаться завершения сеанса и поиска, продолжая обслуживать их запросы
+			closing = true
+			if session != nil {
+				session.cancel()
+			}
+			if probeCancel != nil {
+				probeCancel()
+			}
 
-		case <-x.interrupt:
-			if started {
-				if interruptComport != nil {
-					interruptComport <- struct{}{}
+		case w := <-x.chWrite:
+			if session == nil {
+				w.Error = errNotPolling
+				x.peer.HardwareWrite(w)
+				continue
+			}
+			select {
+			case session.writes <- w:
+			default:
+				w.Error = errors.New("запись невозможна: очередь записи заполнена")
+				x.peer.HardwareWrite(w)
+			}
+
+		case r := <-x.chScan:
+			if err := ValidateScanAddrs(r.addrMin, r.addrMax); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.ScanAddrMin != r.addrMin || cfg.ScanAddrMax != r.addrMax {
+				cfg.ScanAddrMin, cfg.ScanAddrMax = r.addrMin, r.addrMax
+				cfg.Save()
+			}
+			if closing {
+				continue
+			}
+			if session != nil || probeCancel != nil {
+				x.peer.HardwareConnectionError("поиск стенда невозможен во время опроса или другого поиска")
+				continue
+			}
+			ports := []string{net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))}
+			if cfg.Link == LinkSerial {
+				var err error
+				if ports, err = comport.GetAvailablePorts(); err != nil {
+					x.peer.HardwareConnectionError(err.Error())
+					continue
+				}
+			}
+			startProbe(r, ports)
+
+		case r := <-x.probeDone:
+			probeCancel = nil
+			x.peer.HardwareProbe(r.results)
+			if closing {
+				if session == nil {
+					return
 				}
-				currentWorkInterrupted = true
-				waitComport = true
 				continue
 			}
-			return
+			if cfg.Link != LinkSerial {
+				continue
+			}
+			portName, found := bestProbePort(r.results, cfg.Places)
+			if !found {
+				if !r.auto || portExists(r.ports, cfg.SerialPortName) {
+					continue
+				}
+				// устройства стенда не ответили - выбрать первый порт, как до поиска
+				portName = r.ports[0]
+			}
+			if portName != cfg.SerialPortName {
+				cfg.SerialPortName = portName
+				cfg.Save()
+				x.peer.HardwareConfig(cfg)
+			}
 
 		case <-x.comports:
 			ports, err := comport.GetAvailablePorts()
@@ -231,12 +609,14 @@ gotoSelect:
 			// отправить доступные компорты
 			x.peer.ComPorts(ports)
 
-			for _, p := range ports {
-				if p == cfg.SerialPortName {
-					continue gotoSelect
-				}
+			if portExists(ports, cfg.SerialPortName) {
+				continue
+			}
+			if len(ports) > 0 && cfg.Link == LinkSerial && session == nil && probeCancel == nil && !closing {
+				// выбрать порт, через который отвечают устройства стенда
+				startProbe(probeRequest{cfg.ScanAddrMin, cfg.ScanAddrMax, true}, ports)
+				continue
 			}
-
 			if len(ports) > 0 {
 				cfg.SerialPortName = ports[0]
 				cfg.Save()
@@ -245,51 +625,131 @@ gotoSelect:
 			}
 
 		case c := <-x.setPinChecked:
-			cfg.CheckedPlaces[c.pin] = c.checked
+			if c.pin < 0 || c.pin >= len(cfg.Places) {
+				x.peer.HardwareConnectionError(fmt.Sprintf("нет места с номером %d", c.pin+1))
+				continue
+			}
+			cfg.Places[c.pin].Checked = c.checked
+			cfg.Save()
+
+		case places := <-x.setPlaces:
+			if err := ValidatePlaces(places); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			cfg.Places = places
 			cfg.Save()
+			x.peer.HardwareConfig(cfg)
 
 		case portName := <-x.setPortName:
 			if cfg.SerialPortName != portName {
 				cfg.SerialPortName = portName
 				cfg.Save()
 			}
-		case <-x.chComportDone:
-			if waitComport {
-				return
+
+		case link := <-x.setLink:
+			if err := link.Validate(); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.Link != link {
+				cfg.Link = link
+				cfg.Save()
+			}
+
+		case a := <-x.setNetAddress:
+			if a.port <= 0 || a.port > 65535 {
+				x.peer.HardwareConnectionError(fmt.Sprintf("недопустимый номер порта TCP: %d", a.port))
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.Host != a.host || cfg.Port != a.port {
+				cfg.Host = a.host
+				cfg.Port = a.port
+				cfg.Save()
+			}
+		case period := <-x.setCyclePeriod:
+			if period < 0 || period > maxCyclePeriod {
+				x.peer.HardwareConnectionError(fmt.Sprintf("период опроса должен быть от 0 до %d мс: %d", maxCyclePeriod, period))
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.CyclePeriod != period {
+				cfg.CyclePeriod = period
+				cfg.Save()
+			}
+
+		case enabled := <-x.setTrafficLog:
+			x.traffic.setEnabled(enabled)
+			if cfg.TrafficLog != enabled {
+				cfg.TrafficLog = enabled
+				cfg.Save()
+			}
+
+		case s := <-x.setStabilization:
+			if err := s.Validate(); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.Stabilization != s {
+				cfg.Stabilization = s
+				cfg.Save()
 			}
-			started = false
 
-		case <-x.chStart:
-			if !started {
-				started = true
-				currentWorkInterrupted = false
-				go x.runComPort(cfg.SerialPortName)
+		case bits := <-x.setStatusBits:
+			if err := ValidateStatusBits(bits); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
 			}
-		case <-x.chStop:
-			if interruptComport != nil {
-				interruptComport <- struct{}{}
+			cfg.StatusBits = bits
+			cfg.Save()
+
+		case blockRead := <-x.setBlockRead:
+			if cfg.BlockRead != blockRead {
+				cfg.BlockRead = blockRead
+				cfg.Save()
 			}
-			currentWorkInterrupted = true
+
+		case comm := <-x.setComm:
+			if err := comm.Validate(); err != nil {
+				x.peer.HardwareConnectionError(err.Error())
+				x.peer.HardwareConfig(cfg)
+				continue
+			}
+			if cfg.Comm != comm {
+				cfg.Comm = comm
+				cfg.Save()
+			}
+
+		}
+	}
+}
+
+func portExists(ports []string, portName string) bool {
+	for _, p := range ports {
+		if p == portName {
+			return true
 		}
 	}
+	return false
 }
 
-func (x Provider) readPin(port *comport.Port, pin int) (reading Reading) {
+func readPin(ctx context.Context, port Transport, cfg Config, pin int) (reading Reading) {
+	ctx = withPins(ctx, pin)
+	place := cfg.Places[pin]
 
 	reading.Pin = pin
 
-	addr := modbus.Addr(17)
-	n := byte(pin)
-	if pin > 4 {
-		n -= 5
-		addr--
-	}
 	request := modbus.Request{
-		Addr:                addr,
+		Addr:                modbus.Addr(place.Addr),
 		ProtocolCommandCode: 3,
-		Data:                append([]byte{0, 6*n + 2, 0, 1}),
+		Data:                registersData(place.Register+2, 1),
 	}
-	bytes, err := port.Fetch(request.Bytes())
+	bytes, err := port.Fetch(ctx, request.Bytes())
 	if err != nil {
 		reading.Error = err
 		return
@@ -303,26 +763,25 @@ func (x Provider) readPin(port *comport.Port, pin int) (reading Reading) {
 		return
 	}
 
-	if reading.Status = binary.BigEndian.Uint16(bytes[3:]); reading.Status != 0 {
-		reading.Error = fmt.Errorf("статус не ноль: %X", reading.Status)
+	reading.Status = binary.BigEndian.Uint16(bytes[3:])
+	if reading.Flags, reading.Error = decodeStatus(reading.Status, cfg.StatusBits); reading.Error != nil {
 		return
 	}
 
-	if x.CurrentWorkInterrupted() {
-		reading.Error = errors.New("прервано")
+	if reading.Error = ctx.Err(); reading.Error != nil {
 		return
 	}
 
 	request.ProtocolCommandCode = 3
-	request.Data = append([]byte{0, 6*n + 4, 0, 2})
+	request.Data = registersData(place.Register+4, 2)
 
-	bytes, err = port.Fetch(request.Bytes())
+	bytes, err = port.Fetch(ctx, request.Bytes())
 
 	if err != nil {
 		reading.Error = err
 		return
 	}
-	if reading.Error = request.CheckResponse(bytes); reading.Error == nil {
+	if reading.Error = request.CheckResponse(bytes); reading.Error != nil {
 		return
 	}
 	if len(bytes) != 9 {
@@ -330,9 +789,7 @@ func (x Provider) readPin(port *comport.Port, pin int) (reading Reading) {
 		return
 	}
 	reading.Value = math.Float32frombits(binary.BigEndian.Uint32(bytes[3:]))
-	if reading.Value > 1000 {
-		reading.Error = fmt.Errorf("больше тысячи: %v", reading.Value)
-	}
+	reading.Error = place.valueError(reading.Value)
 	return
 
 }
@@ -0,0 +1,465 @@
+package hardware
+
+import (
+	"context"
+	"errors"
+	"github.com/fpawel/ufo82/internal/hardware/simulator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testPeer struct {
+	mu          sync.Mutex
+	connected   bool
+	nConnected  int
+	errors      []string
+	reconnects  []int
+	reconnected int
+	readings    chan Reading
+	probes      chan []ProbeResult
+	writes      chan RegisterWrite
+}
+
+func newTestPeer() *testPeer {
+	return &testPeer{readings: make(chan Reading, 100), probes: make(chan []ProbeResult, 10),
+		writes: make(chan RegisterWrite, 10)}
+}
+
+func (x *testPeer) HardwareConnected() {
+	x.mu.Lock()
+	x.connected = true
+	x.nConnected++
+	x.mu.Unlock()
+}
+
+func (x *testPeer) HardwareReconnect(attempt int, delay time.Duration) {
+	x.mu.Lock()
+	x.reconnects = append(x.reconnects, attempt)
+	x.mu.Unlock()
+}
+
+func (x *testPeer) HardwareReconnected() {
+	x.mu.Lock()
+	x.reconnected++
+	x.mu.Unlock()
+}
+
+func (x *testPeer) HardwareDisconnected() {
+	x.mu.Lock()
+	x.connected = false
+	x.mu.Unlock()
+}
+
+func (x *testPeer) HardwareConnectionError(s string) {
+	x.mu.Lock()
+	x.errors = append(x.errors, s)
+	x.mu.Unlock()
+}
+
+func (x *testPeer) HardwareReading(s Reading) {
+	select {
+	case x.readings <- s:
+	default:
+	}
+}
+
+func (x *testPeer) HardwareConfig(Config)    {}
+func (x *testPeer) HardwareCurrentPlace(int) {}
+func (x *testPeer) ComPorts([]string)        {}
+
+func (x *testPeer) HardwareStable(Reading) {}
+
+func (x *testPeer) HardwareWrite(w RegisterWrite) {
+	x.writes <- w
+}
+
+func (x *testPeer) HardwareProbe(results []ProbeResult) {
+	x.probes <- results
+}
+
+// flakyTransport теряет связь после failAfter запросов, после чего не открывается failOpen раз
+type flakyTransport struct {
+	Loopback
+	failAfter, failOpen int
+	lost                bool
+}
+
+func (x *flakyTransport) Open() error {
+	if x.lost && x.failOpen > 0 {
+		x.failOpen--
+		return errors.New("порт занят")
+	}
+	return x.Loopback.Open()
+}
+
+func (x *flakyTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	if x.failAfter--; x.failAfter == 0 {
+		x.lost = true
+		x.Loopback.Close()
+	}
+	return x.Loopback.Fetch(ctx, request)
+}
+
+// blockingTransport не отвечает на запросы до отмены ctx
+type blockingTransport struct {
+	Loopback
+	fetching chan struct{}
+}
+
+func (x *blockingTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	x.fetching <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func mustStart(t *testing.T, x Provider) *Session {
+	s, err := x.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func tempConfigFilename(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hardware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "hardware.json"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProviderLoopback(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+
+	stand := simulator.New()
+	stand.SetValue(2, 10)
+	stand.SetValue(7, 20)
+	stand.SetStatus(7, 4)
+
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(Config) Transport {
+		return &Loopback{Handler: stand.Handle}
+	})
+	x.SetChecked(2, true)
+	x.SetChecked(7, true)
+	time.Sleep(10 * time.Millisecond)
+	mustStart(t, x)
+
+	got := make(map[int]Reading)
+	for len(got) < 2 {
+		select {
+		case r := <-peer.readings:
+			got[r.Pin] = r
+		case <-time.After(time.Second):
+			t.Fatalf("no readings: %+v", got)
+		}
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := got[2]; r.Error != nil || r.Value != 10 {
+		t.Errorf("place 2: %+v", r)
+	}
+	if r := got[7]; r.Error == nil || r.Status != 4 {
+		t.Errorf("place 7: %+v", r)
+	}
+	if peer.connected {
+		t.Error("not disconnected")
+	}
+}
+
+func TestProviderTopology(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+
+	// стенд на 16 мест
+	stand := simulator.New(simulator.Slave{Addr: 1, Places: 8}, simulator.Slave{Addr: 2, Places: 8})
+	stand.SetValue(15, 15)
+
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(Config) Transport {
+		return &Loopback{Handler: stand.Handle}
+	})
+	defer x.Close()
+	x.SetPlaces(StandPlaces([]byte{1, 2}, 8))
+	time.Sleep(10 * time.Millisecond)
+	x.SetChecked(15, true)
+	time.Sleep(10 * time.Millisecond)
+	mustStart(t, x)
+
+	select {
+	case r := <-peer.readings:
+		if r.Pin != 15 || r.Error != nil || r.Value != 15 {
+			t.Fatalf("%+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no readings")
+	}
+}
+
+func testBlockRead(t *testing.T, stand *simulator.Stand) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+
+	for i := 0; i < 10; i++ {
+		stand.SetValue(i, float32(i))
+	}
+	stand.SetStatus(3, 1)
+
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(Config) Transport {
+		return &Loopback{Handler: stand.Handle}
+	})
+	defer x.Close()
+	x.SetBlockRead(true)
+	for i := 0; i < 10; i++ {
+		x.SetChecked(i, i != 8)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mustStart(t, x)
+
+	got := make(map[int]Reading)
+	for len(got) < 9 {
+		select {
+		case r := <-peer.readings:
+			got[r.Pin] = r
+		case <-time.After(time.Second):
+			t.Fatalf("no readings: %+v", got)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		r, f := got[i]
+		switch {
+		case i == 8:
+			if f {
+				t.Errorf("unchecked place 8: %+v", r)
+			}
+		case i == 3:
+			if r.Error == nil || r.Status != 1 {
+				t.Errorf("place 3: %+v", r)
+			}
+		case r.Error != nil || r.Value != float32(i):
+			t.Errorf("place %d: %+v", i, r)
+		}
+	}
+}
+
+func TestProviderBlockRead(t *testing.T) {
+	testBlockRead(t, simulator.New())
+}
+
+func TestProviderBlockReadRejected(t *testing.T) {
+	// прошивка отклоняет длинный запрос исключением 2 или 3 или не отвечает на него
+	for _, code := range []byte{2, 3, 0} {
+		stand := simulator.New()
+		stand.LimitRead(2)
+		stand.LimitReadException(code)
+		testBlockRead(t, stand)
+	}
+}
+
+func TestProviderReconnect(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	cfg := defaultConfig()
+	cfg.filename = filename
+	cfg.Places[0].Checked = true
+	cfg.ReconnectDelay = 1
+	cfg.Save()
+
+	stand := simulator.New()
+	stand.SetValue(0, 1)
+	port := &flakyTransport{Loopback: Loopback{Handler: stand.Handle}, failAfter: 5, failOpen: 2}
+
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(c Config) Transport {
+		return port
+	})
+	defer x.Close()
+	mustStart(t, x)
+
+	var nOK, nFailed int
+	for nOK < 5 {
+		select {
+		case r := <-peer.readings:
+			if r.Error == nil {
+				nOK++
+			} else {
+				nFailed++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no readings: %d ok, %d failed", nOK, nFailed)
+		}
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if nFailed != 1 || peer.nConnected != 1 || peer.reconnected != 1 ||
+		!reflect.DeepEqual(peer.reconnects, []int{1, 2, 3}) {
+		t.Fatalf("failed %d, connected %d, reconnected %d, attempts %v",
+			nFailed, peer.nConnected, peer.reconnected, peer.reconnects)
+	}
+}
+
+func TestProviderLifecycle(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	cfg := defaultConfig()
+	cfg.filename = filename
+	cfg.Places[0].Checked = true
+	cfg.Save()
+
+	port := &blockingTransport{fetching: make(chan struct{}, 1)}
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(c Config) Transport {
+		return port
+	})
+	s := mustStart(t, x)
+	if _, err := x.Start(context.Background()); err != ErrStarted {
+		t.Fatalf("second start: %v", err)
+	}
+
+	// остановка прерывает запрос, ожидающий ответа
+	select {
+	case <-port.fetching:
+	case <-time.After(time.Second):
+		t.Fatal("no request")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := x.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Err(); err != context.Canceled {
+		t.Fatalf("session error: %v", err)
+	}
+
+	// сеанс завершается и при отмене контекста, переданного Start
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	s, err := x.Start(ctx2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-port.fetching
+	cancel2()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not done")
+	}
+
+	mustStart(t, x)
+	<-port.fetching
+	for i := 0; i < 2; i++ {
+		if err := x.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := x.Start(context.Background()); err != ErrProviderClosed {
+		t.Fatalf("start after close: %v", err)
+	}
+	if err := x.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.connected || peer.nConnected != 3 {
+		t.Fatalf("connected %v, %d times", peer.connected, peer.nConnected)
+	}
+}
+
+func TestProviderScan(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	cfg := defaultConfig()
+	cfg.filename = filename
+	cfg.Link = LinkTCP
+	cfg.Host = "stand"
+	cfg.Save()
+
+	stand := simulator.New()
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(c Config) Transport {
+		return &Loopback{Handler: stand.Handle}
+	})
+	defer x.Close()
+	x.Scan(10, 20)
+
+	select {
+	case results := <-peer.probes:
+		want := []ProbeResult{{Port: "stand:502", Addrs: []byte{16, 17}}}
+		if !reflect.DeepEqual(results, want) {
+			t.Fatalf("%+v", results)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no probe result")
+	}
+	if c := x.Config(); c.ScanAddrMin != 10 || c.ScanAddrMax != 20 {
+		t.Fatalf("scan range not saved: %d - %d", c.ScanAddrMin, c.ScanAddrMax)
+	}
+}
+
+func TestProviderWrite(t *testing.T) {
+	filename, remove := tempConfigFilename(t)
+	defer remove()
+	cfg := defaultConfig()
+	cfg.filename = filename
+	cfg.Places[6].Checked = true
+	cfg.CyclePeriod = 50
+	cfg.Save()
+
+	stand := simulator.New()
+	peer := newTestPeer()
+	x := NewProviderTransport(peer, filename, func(c Config) Transport {
+		return &Loopback{Handler: stand.Handle}
+	})
+	defer x.Close()
+
+	wait := func() RegisterWrite {
+		select {
+		case w := <-peer.writes:
+			return w
+		case <-time.After(time.Second):
+			t.Fatal("no write result")
+		}
+		return RegisterWrite{}
+	}
+
+	x.Write(6, 0, []uint16{1})
+	if w := wait(); w.Error != errNotPolling {
+		t.Fatalf("write without polling: %+v", w)
+	}
+
+	mustStart(t, x)
+	x.Write(6, 0, []uint16{0x2A})
+	if w := wait(); w.Error != nil {
+		t.Fatal(w.Error)
+	}
+	x.Write(6, 4, Float32Registers(7.5, false))
+	if w := wait(); w.Error != nil {
+		t.Fatal(w.Error)
+	}
+	if p := stand.Place(6); p.Registers[0] != 0x2A || p.Value != 7.5 {
+		t.Fatalf("%+v", p)
+	}
+	// записанное значение считывается опросом
+	for {
+		select {
+		case r := <-peer.readings:
+			if r.Value == 7.5 {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("written value not read")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package hardware
+
+import "time"
+
+// scheduler - расписание опроса. Циклы начинаются в моменты start + k*period независимо от
+// длительности опроса, пропущенные из-за долгого опроса циклы не наверстываются.
+// Место с интервалом опроса опрашивается в первом цикле, начавшемся не раньше срока
+type scheduler struct {
+	start time.Time
+	cycle int64
+	due   map[int]time.Time
+}
+
+func newScheduler(start time.Time) *scheduler {
+	return &scheduler{
+		start: start,
+		cycle: -1,
+		due:   make(map[int]time.Time),
+	}
+}
+
+// nextCycle возвращает время начала следующего цикла с периодом period, наступающего не раньше now,
+// или now, если период не задан
+func (x *scheduler) nextCycle(now time.Time, period time.Duration) time.Time {
+	if period <= 0 {
+		return now
+	}
+	x.cycle++
+	if t := x.start.Add(time.Duration(x.cycle) * period); !t.Before(now) {
+		return t
+	}
+	// пропустить циклы, время которых уже прошло
+	x.cycle = int64((now.Sub(x.start) + period - 1) / period)
+	return x.start.Add(time.Duration(x.cycle) * period)
+}
+
+// firstDue возвращает ближайший не раньше now срок опроса выбранных мест places: now, если
+// есть место без интервала или место, срок которого наступил
+func (x *scheduler) firstDue(now time.Time, places []Place) time.Time {
+	t := time.Time{}
+	for i, p := range places {
+		if !p.Checked {
+			continue
+		}
+		due, f := x.due[i]
+		if p.Interval <= 0 || !f || !due.After(now) {
+			return now
+		}
+		if t.IsZero() || due.Before(t) {
+			t = due
+		}
+	}
+	if t.IsZero() {
+		return now
+	}
+	return t
+}
+
+// placeDue сообщает, нужно ли опрашивать место pin с интервалом interval в цикле, начавшемся в t,
+// и если нужно, назначает срок следующего опроса
+func (x *scheduler) placeDue(pin int, interval time.Duration, t time.Time) bool {
+	if interval <= 0 {
+		delete(x.due, pin)
+		return true
+	}
+	due, f := x.due[pin]
+	if f && t.Before(due) {
+		return false
+	}
+	if !f {
+		due = t
+	}
+	// срок следующего опроса отсчитывается от срока текущего, а не от времени цикла
+	n := t.Sub(due)/interval + 1
+	x.due[pin] = due.Add(n * interval)
+	return true
+}
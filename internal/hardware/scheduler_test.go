@@ -0,0 +1,88 @@
+package hardware
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedulerNextCycle(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	x := newScheduler(t0)
+	sec := func(n float64) time.Time {
+		return t0.Add(time.Duration(n * float64(time.Second)))
+	}
+
+	for _, c := range []struct {
+		now, want time.Time
+	}{
+		{t0, t0},
+		// опрос длился 0.3 с - следующий цикл через секунду от начала предыдущего
+		{sec(0.3), sec(1)},
+		{sec(1.9), sec(2)},
+		// опрос длился дольше двух периодов - циклы 3 и 4 пропущены
+		{sec(4.5), sec(5)},
+		{sec(5), sec(6)},
+	} {
+		if got := x.nextCycle(c.now, time.Second); !got.Equal(c.want) {
+			t.Errorf("now %v: %v, want %v", c.now.Sub(t0), got.Sub(t0), c.want.Sub(t0))
+		}
+	}
+
+	if got := x.nextCycle(sec(7.7), 0); !got.Equal(sec(7.7)) {
+		t.Errorf("no period: %v", got.Sub(t0))
+	}
+}
+
+func TestSchedulerPlaceDue(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	x := newScheduler(t0)
+
+	var got []int
+	for n := 0; n < 10; n++ {
+		tm := t0.Add(time.Duration(n) * time.Second)
+		if x.placeDue(0, 3*time.Second, tm) {
+			got = append(got, n)
+		}
+		if !x.placeDue(1, 0, tm) {
+			t.Errorf("place without interval not due at %d", n)
+		}
+	}
+	if want := []int{0, 3, 6, 9}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("%v, want %v", got, want)
+	}
+
+	// циклы с задержкой не сдвигают сроки опроса
+	x = newScheduler(t0)
+	got = nil
+	for _, ms := range []int{0, 1100, 2100, 3050, 4000, 5000, 6100} {
+		if x.placeDue(0, 2*time.Second, t0.Add(time.Duration(ms)*time.Millisecond)) {
+			got = append(got, ms)
+		}
+	}
+	if want := []int{0, 2100, 4000, 6100}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("%v, want %v", got, want)
+	}
+}
+
+func TestSchedulerFirstDue(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	x := newScheduler(t0)
+	places := []Place{
+		{Checked: true, Interval: 3000},
+		{Checked: true, Interval: 2000},
+		{Interval: 0},
+	}
+	if got := x.firstDue(t0, places); !got.Equal(t0) {
+		t.Fatalf("not polled yet: %v", got.Sub(t0))
+	}
+	x.placeDue(0, 3*time.Second, t0)
+	x.placeDue(1, 2*time.Second, t0)
+	if got := x.firstDue(t0.Add(time.Second), places); !got.Equal(t0.Add(2 * time.Second)) {
+		t.Fatalf("earliest due: %v", got.Sub(t0))
+	}
+	places[2].Checked = true
+	if got := x.firstDue(t0.Add(time.Second), places); !got.Equal(t0.Add(time.Second)) {
+		t.Fatalf("place without interval: %v", got.Sub(t0))
+	}
+}
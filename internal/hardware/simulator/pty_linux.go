@@ -0,0 +1,90 @@
+package simulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Pty - пара псевдотерминалов: стенд обслуживает ведущий, Name - имя ведомого для открытия как COM порта
+type Pty struct {
+	Name          string
+	master, slave *os.File
+	done          chan error
+}
+
+// StartPty создаёт пару псевдотерминалов и обслуживает запросы, поступающие в ведомый терминал
+func (x *Stand) StartPty() (*Pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, err
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	// ведомый терминал держим открытым, чтобы чтение ведущего не завершалось ошибкой,
+	// пока порт не открыт тестируемой стороной
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(slave); err != nil {
+		slave.Close()
+		master.Close()
+		return nil, err
+	}
+
+	p := &Pty{
+		Name:   name,
+		master: master,
+		slave:  slave,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		p.done <- x.Serve(master)
+	}()
+	return p, nil
+}
+
+func (x *Pty) Close() error {
+	errSlave := x.slave.Close()
+	err := x.master.Close()
+	<-x.done
+	if err == nil {
+		err = errSlave
+	}
+	return err
+}
+
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, arg); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package simulator
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPty(t *testing.T) {
+	x := New()
+	x.SetStatus(9, 0xA)
+	p, err := x.StartPty()
+	if err != nil {
+		t.Skip("pty:", err)
+	}
+	defer p.Close()
+
+	port, err := os.OpenFile(p.Name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	if _, err := port.Write(readRequest(16, 6*4+2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	want := response(16, 3, 2, 0, 0xA)
+	var got []byte
+	b := make([]byte, 16)
+	port.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < len(want) {
+		n, err := port.Read(b)
+		if err != nil {
+			t.Fatal(err, got)
+		}
+		got = append(got, b[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("% X, want % X", got, want)
+	}
+}
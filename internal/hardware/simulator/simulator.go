@@ -0,0 +1,326 @@
+// Package simulator эмулирует стенд УФО-82 - modbus RTU устройства, каждое из которых обслуживает
+// несколько мест стенда. Регистры места n устройства: статус - 6*n+2, значение float32 - 6*n+4,
+// остальные регистры блока места хранят записанные в них значения.
+package simulator
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+)
+
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	// FaultTimeout - не отвечать на запрос
+	FaultTimeout
+	// FaultCRC - испортить контрольную сумму ответа
+	FaultCRC
+)
+
+type Slave struct {
+	Addr   byte
+	Places int
+}
+
+type Place struct {
+	Status uint16
+	Value  float32
+	// Fault - неисправность, проявляющаяся при каждом запросе к месту
+	Fault Fault
+	// ValueFunc, если задана, вычисляет значение по порядковому номеру запроса значения места
+	ValueFunc func(n int) float32
+	// Registers - регистры блока места, не занятые статусом и значением
+	Registers [6]uint16
+}
+
+type Stand struct {
+	mu     sync.Mutex
+	slaves []Slave
+	places []Place
+	// однократные неисправности мест, расходуются по одной на каждый запрос
+	faults   [][]Fault
+	nValues  []int
+	requests int
+	maxCount int
+	// limitCode - исключение в ответ на запрос длиннее maxCount, 0 - не отвечать
+	limitCode byte
+}
+
+// DefaultSlaves - раскладка стенда УФО-82: места 0-4 у устройства 17, места 5-9 у устройства 16
+var DefaultSlaves = []Slave{
+	{Addr: 17, Places: 5},
+	{Addr: 16, Places: 5},
+}
+
+func New(slaves ...Slave) *Stand {
+	if len(slaves) == 0 {
+		slaves = DefaultSlaves
+	}
+	x := &Stand{slaves: slaves, limitCode: 2}
+	for _, s := range slaves {
+		for i := 0; i < s.Places; i++ {
+			x.places = append(x.places, Place{})
+			x.faults = append(x.faults, nil)
+			x.nValues = append(x.nValues, 0)
+		}
+	}
+	return x
+}
+
+func (x *Stand) Update(place int, f func(*Place)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	f(&x.places[place])
+}
+
+func (x *Stand) SetValue(place int, value float32) {
+	x.Update(place, func(p *Place) {
+		p.Value = value
+	})
+}
+
+func (x *Stand) SetStatus(place int, status uint16) {
+	x.Update(place, func(p *Place) {
+		p.Status = status
+	})
+}
+
+func (x *Stand) SetFault(place int, fault Fault) {
+	x.Update(place, func(p *Place) {
+		p.Fault = fault
+	})
+}
+
+// Script ставит в очередь однократные неисправности места: каждый следующий запрос к месту
+// расходует одну из них, FaultNone - корректный ответ
+func (x *Stand) Script(place int, faults ...Fault) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.faults[place] = append(x.faults[place], faults...)
+}
+
+// LimitRead ограничивает количество регистров в запросе чтения, как прошивки, не поддерживающие
+// чтение длинных блоков. Ноль снимает ограничение
+func (x *Stand) LimitRead(count int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.maxCount = count
+}
+
+// LimitReadException задаёт ответ на запрос длиннее LimitRead: исключение code или, если code
+// равен 0, отсутствие ответа. По умолчанию - исключение 2
+func (x *Stand) LimitReadException(code byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.limitCode = code
+}
+
+// Place возвращает состояние места
+func (x *Stand) Place(place int) Place {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.places[place]
+}
+
+// Requests - количество принятых запросов с верной контрольной суммой
+func (x *Stand) Requests() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.requests
+}
+
+// Handle обрабатывает кадр запроса modbus RTU и возвращает кадр ответа или nil, если
+// устройство не должно отвечать
+func (x *Stand) Handle(request []byte) []byte {
+	if len(request) < 4 || crc16(request) != 0 {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.requests++
+	addr, code := request[0], request[1]
+	firstPlace, slave, ok := x.slave(addr)
+	if !ok {
+		return nil
+	}
+	if len(request) != frameLen(request) {
+		return response(addr, code|0x80, 1)
+	}
+	reg := int(binary.BigEndian.Uint16(request[2:]))
+	count := 1
+	switch code {
+	case 3, 16:
+		count = int(binary.BigEndian.Uint16(request[4:]))
+	case 6:
+	default:
+		return response(addr, code|0x80, 1)
+	}
+	maxCount := 125
+	if code == 16 {
+		maxCount = 123
+	}
+	if count == 0 || count > maxCount || reg+count > 6*slave.Places ||
+		code == 16 && int(request[6]) != 2*count {
+		return response(addr, code|0x80, 2)
+	}
+	if code == 3 && x.maxCount > 0 && count > x.maxCount {
+		if x.limitCode == 0 {
+			return nil
+		}
+		return response(addr, code|0x80, x.limitCode)
+	}
+	place := firstPlace + reg/6
+	fault := x.places[place].Fault
+	if xs := x.faults[place]; len(xs) > 0 {
+		fault, x.faults[place] = xs[0], xs[1:]
+	}
+	if fault == FaultTimeout {
+		return nil
+	}
+
+	var b []byte
+	switch code {
+	case 3:
+		data := []byte{byte(2 * count)}
+		for i := reg; i < reg+count; i++ {
+			data = append(data, 0, 0)
+			binary.BigEndian.PutUint16(data[len(data)-2:], x.register(firstPlace, i))
+		}
+		for i := reg; i < reg+count; i++ {
+			if i%6 == 4 {
+				x.nValues[firstPlace+i/6]++
+			}
+		}
+		b = response(addr, code, data...)
+	case 6:
+		x.setRegister(firstPlace, reg, binary.BigEndian.Uint16(request[4:]))
+		// ответ повторяет запрос
+		b = response(addr, code, request[2:6]...)
+	case 16:
+		for i := 0; i < count; i++ {
+			x.setRegister(firstPlace, reg+i, binary.BigEndian.Uint16(request[7+2*i:]))
+		}
+		b = response(addr, code, request[2:6]...)
+	}
+	if fault == FaultCRC {
+		b[len(b)-1] ^= 0xFF
+	}
+	return b
+}
+
+// Serve обслуживает запросы, поступающие из rw, до ошибки чтения или записи
+func (x *Stand) Serve(rw io.ReadWriter) error {
+	var buf []byte
+	b := make([]byte, 256)
+	for {
+		n, err := rw.Read(b)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b[:n]...)
+		for {
+			n := frameLen(buf)
+			if n == 0 || n > len(buf) {
+				break
+			}
+			request := buf[:n]
+			buf = buf[n:]
+			if r := x.Handle(request); r != nil {
+				if _, err := rw.Write(r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (x *Stand) slave(addr byte) (int, Slave, bool) {
+	firstPlace := 0
+	for _, s := range x.slaves {
+		if s.Addr == addr {
+			return firstPlace, s, true
+		}
+		firstPlace += s.Places
+	}
+	return 0, Slave{}, false
+}
+
+func (x *Stand) register(firstPlace, reg int) uint16 {
+	n := firstPlace + reg/6
+	p := &x.places[n]
+	switch reg % 6 {
+	case 2:
+		return p.Status
+	case 4:
+		return uint16(math.Float32bits(x.value(n)) >> 16)
+	case 5:
+		return uint16(math.Float32bits(x.value(n)))
+	}
+	return p.Registers[reg%6]
+}
+
+func (x *Stand) setRegister(firstPlace, reg int, value uint16) {
+	p := &x.places[firstPlace+reg/6]
+	switch reg % 6 {
+	case 2:
+		p.Status = value
+	case 4:
+		p.Value = math.Float32frombits(math.Float32bits(p.Value)&0xFFFF | uint32(value)<<16)
+	case 5:
+		p.Value = math.Float32frombits(math.Float32bits(p.Value)&0xFFFF0000 | uint32(value))
+	default:
+		p.Registers[reg%6] = value
+	}
+}
+
+func (x *Stand) value(place int) float32 {
+	p := &x.places[place]
+	if p.ValueFunc == nil {
+		return p.Value
+	}
+	// значение занимает два регистра, оба должны быть вычислены для одного и того же n
+	return p.ValueFunc(x.nValues[place])
+}
+
+func response(addr, code byte, data ...byte) []byte {
+	b := append([]byte{addr, code}, data...)
+	c := crc16(b)
+	return append(b, byte(c), byte(c>>8))
+}
+
+// frameLen возвращает длину кадра запроса в начале b или 0, если её пока нельзя определить.
+// Для неизвестной функции - длину b
+func frameLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[1] {
+	case 3, 6:
+		return 8
+	case 16:
+		if len(b) < 7 {
+			return 0
+		}
+		return 9 + int(b[6])
+	}
+	return len(b)
+}
+
+func crc16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,156 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func request(addr, code byte, data ...byte) []byte {
+	return response(addr, code, data...)
+}
+
+func readRequest(addr byte, reg, count uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, reg)
+	binary.BigEndian.PutUint16(b[2:], count)
+	return request(addr, 3, b...)
+}
+
+func TestHandleStatusAndValue(t *testing.T) {
+	x := New()
+	x.SetStatus(7, 0x12)
+	x.SetValue(7, 12.5)
+
+	// место 7 - второе место устройства 16
+	b := x.Handle(readRequest(16, 6*2+2, 1))
+	if want := response(16, 3, 2, 0, 0x12); !bytes.Equal(b, want) {
+		t.Fatalf("status: % X, want % X", b, want)
+	}
+
+	b = x.Handle(readRequest(16, 6*2+4, 2))
+	if len(b) != 9 || crc16(b) != 0 {
+		t.Fatalf("value: % X", b)
+	}
+	if v := math.Float32frombits(binary.BigEndian.Uint32(b[3:])); v != 12.5 {
+		t.Fatalf("value: %v", v)
+	}
+}
+
+func TestHandleValueFunc(t *testing.T) {
+	x := New()
+	x.Update(0, func(p *Place) {
+		p.ValueFunc = func(n int) float32 {
+			return float32(n)
+		}
+	})
+	for n := 0; n < 3; n++ {
+		b := x.Handle(readRequest(17, 4, 2))
+		if v := math.Float32frombits(binary.BigEndian.Uint32(b[3:])); v != float32(n) {
+			t.Fatalf("%d: %v", n, v)
+		}
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	x := New()
+
+	if b := x.Handle(readRequest(1, 2, 1)); b != nil {
+		t.Errorf("unknown address: % X", b)
+	}
+
+	bad := readRequest(17, 2, 1)
+	bad[len(bad)-1] ^= 1
+	if b := x.Handle(bad); b != nil {
+		t.Errorf("bad request crc: % X", b)
+	}
+
+	if b, want := x.Handle(readRequest(17, 28, 4)), response(17, 0x83, 2); !bytes.Equal(b, want) {
+		t.Errorf("illegal address: % X, want % X", b, want)
+	}
+
+	if b, want := x.Handle(request(17, 4, 0, 2, 0, 1)), response(17, 0x84, 1); !bytes.Equal(b, want) {
+		t.Errorf("illegal function: % X, want % X", b, want)
+	}
+}
+
+func TestHandleWrite(t *testing.T) {
+	x := New()
+
+	// команда в регистр 0 места 6 - второго места устройства 16
+	req := request(16, 6, 0, 6, 0, 0x2A)
+	if b := x.Handle(req); !bytes.Equal(b, req) {
+		t.Fatalf("write single: % X", b)
+	}
+	if b, want := x.Handle(readRequest(16, 6, 1)), response(16, 3, 2, 0, 0x2A); !bytes.Equal(b, want) {
+		t.Fatalf("read written: % X, want % X", b, want)
+	}
+
+	v := math.Float32bits(2.5)
+	req = request(16, 16, 0, 6+4, 0, 2, 4, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	if b, want := x.Handle(req), response(16, 16, 0, 6+4, 0, 2); !bytes.Equal(b, want) {
+		t.Fatalf("write multiple: % X, want % X", b, want)
+	}
+	if p := x.Place(6); p.Value != 2.5 || p.Registers[0] != 0x2A {
+		t.Fatalf("%+v", p)
+	}
+
+	if b, want := x.Handle(request(16, 16, 0, 29, 0, 2, 4, 0, 0, 0, 0)), response(16, 0x90, 2); !bytes.Equal(b, want) {
+		t.Fatalf("illegal address: % X, want % X", b, want)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	x := New()
+	x.Script(3, FaultTimeout, FaultCRC, FaultNone)
+
+	if b := x.Handle(readRequest(17, 6*3+2, 1)); b != nil {
+		t.Errorf("timeout: % X", b)
+	}
+	if b := x.Handle(readRequest(17, 6*3+2, 1)); b == nil || crc16(b) == 0 {
+		t.Errorf("crc: % X", b)
+	}
+	if b := x.Handle(readRequest(17, 6*3+2, 1)); b == nil || crc16(b) != 0 {
+		t.Errorf("none: % X", b)
+	}
+
+	x.SetFault(3, FaultTimeout)
+	if b := x.Handle(readRequest(17, 6*3+2, 1)); b != nil {
+		t.Errorf("persistent timeout: % X", b)
+	}
+	// неисправность места 3 не влияет на место 4
+	if b := x.Handle(readRequest(17, 6*4+2, 1)); b == nil {
+		t.Error("place 4: no response")
+	}
+}
+
+func TestServe(t *testing.T) {
+	x := New()
+	x.SetValue(0, 1)
+	var in, out bytes.Buffer
+	in.Write(readRequest(17, 2, 1))
+	// кадр значения приходит по частям
+	in.Write(readRequest(17, 4, 2))
+	if err := x.Serve(&readWriter{&in, &out}); err == nil {
+		t.Fatal("no error at EOF")
+	}
+	if out.Len() != 7+9 {
+		t.Fatalf("% X", out.Bytes())
+	}
+}
+
+type readWriter struct {
+	r, w *bytes.Buffer
+}
+
+func (x *readWriter) Read(p []byte) (int, error) {
+	if len(p) > 5 {
+		p = p[:5]
+	}
+	return x.r.Read(p)
+}
+
+func (x *readWriter) Write(p []byte) (int, error) {
+	return x.w.Write(p)
+}
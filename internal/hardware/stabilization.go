@@ -0,0 +1,84 @@
+package hardware
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Stabilization - условие установления показания места: за время Window показание изменилось
+// не больше чем на MaxDrift, а среднеквадратичное отклонение показаний не больше MaxNoise
+type Stabilization struct {
+	// Window - длительность окна в миллисекундах, 0 - не определять установление
+	Window   int
+	MaxDrift float64
+	MaxNoise float64
+}
+
+func (x Stabilization) Validate() error {
+	if x.Window < 0 || x.Window > maxCyclePeriod {
+		return fmt.Errorf("окно установления должно быть от 0 до %d мс: %d", maxCyclePeriod, x.Window)
+	}
+	if x.MaxDrift < 0 || x.MaxNoise < 0 {
+		return fmt.Errorf("дрейф и шум установления не должны быть отрицательными: %v, %v", x.MaxDrift, x.MaxNoise)
+	}
+	return nil
+}
+
+// stabilizer определяет установление показаний мест в сеансе опроса
+type stabilizer struct {
+	places map[int]*placeWindow
+}
+
+// placeWindow - показания места за окно установления и одно показание перед окном
+type placeWindow struct {
+	times  []time.Time
+	values []float64
+	stable bool
+}
+
+func newStabilizer() *stabilizer {
+	return &stabilizer{places: make(map[int]*placeWindow)}
+}
+
+// add добавляет показание места. stable - показание установилось,
+// settled - установилось с этим показанием
+func (x *stabilizer) add(s Stabilization, r Reading) (stable, settled bool) {
+	if s.Window <= 0 {
+		return false, false
+	}
+	w := x.places[r.Pin]
+	if w == nil || r.Error != nil {
+		// ошибка прерывает ряд показаний, установление определяется заново
+		w = new(placeWindow)
+		x.places[r.Pin] = w
+	}
+	if r.Error != nil {
+		return false, false
+	}
+	w.times = append(w.times, r.Time)
+	w.values = append(w.values, float64(r.Value))
+	start := r.Time.Add(-millis(s.Window))
+	for len(w.times) > 1 && !w.times[1].After(start) {
+		w.times, w.values = w.times[1:], w.values[1:]
+	}
+	wasStable := w.stable
+	w.stable = len(w.times) > 1 && !w.times[0].After(start) &&
+		math.Abs(w.values[len(w.values)-1]-w.values[0]) <= s.MaxDrift &&
+		deviation(w.values) <= s.MaxNoise
+	return w.stable, w.stable && !wasStable
+}
+
+// deviation - среднеквадратичное отклонение
+func deviation(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+	var sum2 float64
+	for _, x := range xs {
+		sum2 += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum2 / float64(len(xs)))
+}
@@ -0,0 +1,49 @@
+package hardware
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStabilizer(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := Stabilization{Window: 3000, MaxDrift: 0.1, MaxNoise: 0.05}
+	x := newStabilizer()
+	add := func(n int, v float32) (bool, bool) {
+		return x.add(s, Reading{Pin: 1, Value: v, Time: t0.Add(time.Duration(n) * time.Second)})
+	}
+
+	var settledAt []int
+	for n, v := range []float32{5, 3, 2, 1.5, 1.2, 1.1, 1.05, 1.02, 1.01, 1.0, 1.0, 1.01} {
+		stable, settled := add(n, v)
+		if settled {
+			settledAt = append(settledAt, n)
+		}
+		if n < 3 && stable {
+			t.Fatalf("stable before window filled: %d", n)
+		}
+	}
+	if len(settledAt) != 1 || settledAt[0] != 8 {
+		t.Fatalf("settled at %v", settledAt)
+	}
+
+	// ошибка сбрасывает окно
+	x.add(s, Reading{Pin: 1, Error: errors.New("нет ответа"), Time: t0.Add(12 * time.Second)})
+	if stable, _ := add(13, 1); stable {
+		t.Fatal("stable after error")
+	}
+
+	// скачок показания - место снова не установилось
+	x = newStabilizer()
+	for n := 0; n < 5; n++ {
+		add(n, 1)
+	}
+	if stable, _ := add(5, 2); stable {
+		t.Fatal("stable after jump")
+	}
+
+	if stable, _ := x.add(Stabilization{}, Reading{Pin: 1, Value: 1, Time: t0}); stable {
+		t.Fatal("stable with detection disabled")
+	}
+}
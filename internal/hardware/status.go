@@ -0,0 +1,83 @@
+package hardware
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// StatusBits - количество бит слова статуса места
+const StatusBits = 16
+
+// StatusBit - флаг слова статуса места
+type StatusBit struct {
+	// Bit - номер бита слова статуса от 0 до 15
+	Bit  uint
+	Name string
+	// Fault - установленный флаг означает, что показание места недостоверно
+	Fault bool
+}
+
+// defaultStatusBits - флаги статуса по умолчанию. Как и до их настройки, любой установленный бит
+// означает недостоверное показание
+func defaultStatusBits() []StatusBit {
+	return []StatusBit{
+		{Bit: 0, Name: "неисправность датчика", Fault: true},
+		{Bit: 1, Name: "выход за диапазон", Fault: true},
+		{Bit: 2, Name: "прогрев", Fault: true},
+	}
+}
+
+func ValidateStatusBits(bits []StatusBit) error {
+	m := make(map[uint]bool)
+	for _, b := range bits {
+		if b.Bit >= StatusBits {
+			return fmt.Errorf("недопустимый номер бита статуса: %d", b.Bit)
+		}
+		if m[b.Bit] {
+			return fmt.Errorf("бит статуса %d задан дважды", b.Bit)
+		}
+		if strings.TrimSpace(b.Name) == "" {
+			return fmt.Errorf("не задано название бита статуса %d", b.Bit)
+		}
+		m[b.Bit] = true
+	}
+	return nil
+}
+
+// decodeStatus возвращает названия установленных флагов статуса и ошибку, если среди них есть
+// флаги неисправности или биты, отсутствующие в bits
+func decodeStatus(status uint16, bits []StatusBit) (flags []string, err error) {
+	var faults []string
+	for n := uint(0); n < StatusBits; n++ {
+		if status&(1<<n) == 0 {
+			continue
+		}
+		name, fault := fmt.Sprintf("бит %d", n), true
+		for _, b := range bits {
+			if b.Bit == n {
+				name, fault = b.Name, b.Fault
+			}
+		}
+		flags = append(flags, name)
+		if fault {
+			faults = append(faults, name)
+		}
+	}
+	if len(faults) > 0 {
+		err = fmt.Errorf("статус %04X: %s", status, strings.Join(faults, ", "))
+	}
+	return
+}
+
+// valueError проверяет, что значение value в пределах допустимых значений места
+func (x Place) valueError(value float32) error {
+	if math.IsNaN(float64(value)) {
+		return errors.New("значение не число")
+	}
+	if v := float64(value); v < x.ValueMin || v > x.ValueMax {
+		return fmt.Errorf("значение %v вне допустимого диапазона от %v до %v", value, x.ValueMin, x.ValueMax)
+	}
+	return nil
+}
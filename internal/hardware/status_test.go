@@ -0,0 +1,46 @@
+package hardware
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeStatus(t *testing.T) {
+	bits := []StatusBit{
+		{Bit: 0, Name: "неисправность", Fault: true},
+		{Bit: 3, Name: "калибровка"},
+	}
+	if flags, err := decodeStatus(0, bits); flags != nil || err != nil {
+		t.Fatal(flags, err)
+	}
+	flags, err := decodeStatus(8, bits)
+	if !reflect.DeepEqual(flags, []string{"калибровка"}) || err != nil {
+		t.Fatal(flags, err)
+	}
+	flags, err = decodeStatus(0x8009, bits)
+	if !reflect.DeepEqual(flags, []string{"неисправность", "калибровка", "бит 15"}) || err == nil ||
+		err.Error() != "статус 8009: неисправность, бит 15" {
+		t.Fatal(flags, err)
+	}
+	if err := ValidateStatusBits(append(bits, StatusBit{Bit: 3, Name: "x"})); err == nil {
+		t.Fatal("повтор бита")
+	}
+	if err := ValidateStatusBits([]StatusBit{{Bit: 16, Name: "x"}}); err == nil {
+		t.Fatal("бит 16")
+	}
+}
+
+func TestPlaceValueError(t *testing.T) {
+	p := Place{ValueMin: -5, ValueMax: 10}
+	for _, v := range []float32{-5, 0, 10} {
+		if err := p.valueError(v); err != nil {
+			t.Error(v, err)
+		}
+	}
+	for _, v := range []float32{-5.5, 10.5, float32(math.NaN())} {
+		if err := p.valueError(v); err == nil {
+			t.Error(v)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// trafficFileSize - размер файла журнала обмена, после которого начинается новый файл
+	trafficFileSize = 10 << 20
+	// trafficFiles - количество хранимых файлов журнала обмена, включая текущий
+	trafficFiles = 5
+)
+
+// trafficLog записывает кадры запросов и ответов modbus в текстовые файлы dir/modbus.log,
+// modbus.log.1 ... - от новых к старым. При превышении размера текущий файл сдвигается,
+// самый старый удаляется
+type trafficLog struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	enabled  bool
+	file     *os.File
+	size     int64
+}
+
+func newTrafficLog(dir string) *trafficLog {
+	return &trafficLog{dir: dir, maxSize: trafficFileSize, maxFiles: trafficFiles}
+}
+
+func (x *trafficLog) filename(n int) string {
+	name := filepath.Join(x.dir, "modbus.log")
+	if n > 0 {
+		name += fmt.Sprintf(".%d", n)
+	}
+	return name
+}
+
+// setEnabled включает или выключает запись. При выключении текущий файл закрывается
+func (x *trafficLog) setEnabled(enabled bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.enabled = enabled
+	if !enabled {
+		x.closeFile()
+	}
+}
+
+func (x *trafficLog) isEnabled() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.enabled
+}
+
+func (x *trafficLog) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.enabled = false
+	return x.closeFile()
+}
+
+func (x *trafficLog) closeFile() error {
+	if x.file == nil {
+		return nil
+	}
+	err := x.file.Close()
+	x.file = nil
+	return err
+}
+
+func (x *trafficLog) write(line string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.enabled {
+		return
+	}
+	if x.file != nil && x.size+int64(len(line)) > x.maxSize {
+		x.closeFile()
+		x.rotate()
+	}
+	if x.file == nil {
+		if err := x.openFile(); err != nil {
+			fmt.Println("журнал обмена:", err)
+			x.enabled = false
+			return
+		}
+	}
+	n, err := x.file.WriteString(line)
+	x.size += int64(n)
+	if err != nil {
+		fmt.Println("журнал обмена:", err)
+	}
+}
+
+func (x *trafficLog) openFile() error {
+	if err := os.MkdirAll(x.dir, os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(x.filename(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	x.file, x.size = file, info.Size()
+	return nil
+}
+
+func (x *trafficLog) rotate() {
+	if err := os.Remove(x.filename(x.maxFiles - 1)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("журнал обмена:", err)
+	}
+	for n := x.maxFiles - 2; n >= 0; n-- {
+		if err := os.Rename(x.filename(n), x.filename(n+1)); err != nil && !os.IsNotExist(err) {
+			fmt.Println("журнал обмена:", err)
+		}
+	}
+}
+
+// record записывает строку журнала: время запроса, места, адрес, кадры запроса и ответа,
+// длительность и результат обмена. При выключенной записи строка не формируется
+func (x *trafficLog) record(t time.Time, pins []int, request, response []byte, err error) {
+	if !x.isEnabled() {
+		return
+	}
+	places := make([]string, len(pins))
+	for i, pin := range pins {
+		places[i] = fmt.Sprint(pin + 1)
+	}
+	var addr byte
+	if len(request) > 0 {
+		addr = request[0]
+	}
+	x.write(fmt.Sprintf("%s место %s адрес %d % X -> % X %d мс: %s\n",
+		t.Format("2006-01-02 15:04:05.000"), strings.Join(places, ","), addr, request, response,
+		time.Since(t)/time.Millisecond, trafficOutcome(response, err)))
+}
+
+func trafficOutcome(response []byte, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if crc16(response) != 0 {
+		return "ошибка CRC"
+	}
+	if code, f := exceptionCode(response); f {
+		return fmt.Sprintf("исключение modbus %d", code)
+	}
+	return "ok"
+}
+
+// trafficTransport записывает в журнал каждый обмен канала связи
+type trafficTransport struct {
+	Transport
+	log *trafficLog
+}
+
+func (x trafficTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	t := time.Now()
+	response, err := x.Transport.Fetch(ctx, request)
+	x.log.record(t, contextPins(ctx), request, response, err)
+	return response, err
+}
+
+type pinsKey struct{}
+
+// withPins сохраняет в ctx места стенда, к которым относятся запросы, для журнала обмена
+func withPins(ctx context.Context, pins ...int) context.Context {
+	return context.WithValue(ctx, pinsKey{}, pins)
+}
+
+func contextPins(ctx context.Context) []int {
+	pins, _ := ctx.Value(pinsKey{}).([]int)
+	return pins
+}
@@ -0,0 +1,92 @@
+package hardware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficLogRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	x := newTrafficLog(dir)
+	port := trafficTransport{&Loopback{Handler: func(request []byte) []byte {
+		return []byte{0x11, 0x83, 0x02, 0xC1, 0x34}
+	}}, x}
+	port.Open()
+	ctx := withPins(context.Background(), 0, 1)
+
+	// запись выключена
+	port.Fetch(ctx, []byte{0x11, 0x03})
+	if _, err := os.Stat(x.filename(0)); !os.IsNotExist(err) {
+		t.Fatalf("log written while disabled: %v", err)
+	}
+
+	x.setEnabled(true)
+	port.Fetch(ctx, []byte{0x11, 0x03})
+	port.Close()
+	port.Fetch(ctx, []byte{0x11, 0x03})
+	x.Close()
+
+	b, err := ioutil.ReadFile(x.filename(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], "место 1,2 адрес 17 11 03 -> 11 83 02 C1 34") ||
+		!strings.HasSuffix(lines[0], "исключение modbus 2") ||
+		!strings.HasSuffix(lines[1], ErrClosed.Error()) {
+		t.Fatalf("%q", lines)
+	}
+}
+
+func TestTrafficLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	x := newTrafficLog(dir)
+	x.maxSize = 200
+	x.maxFiles = 3
+	x.setEnabled(true)
+	for i := 0; i < 20; i++ {
+		x.record(time.Now(), []int{i}, []byte{1, 3, 0, 2}, nil, errors.New("нет ответа"))
+	}
+	x.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "modbus.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("%v", files)
+	}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > x.maxSize {
+			t.Errorf("%s: %d bytes", name, info.Size())
+		}
+	}
+	b, err := ioutil.ReadFile(x.filename(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "место 20 ") {
+		t.Fatalf("last record not in current file: %s", b)
+	}
+}
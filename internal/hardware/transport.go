@@ -0,0 +1,171 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+	"github.com/fpawel/guartutils/comport"
+	"github.com/fpawel/guartutils/fetch"
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+	"sync"
+	"time"
+)
+
+// Transport - канал связи со стендом, по которому передаются кадры modbus RTU
+type Transport interface {
+	Open() error
+	Close() error
+	// Fetch отправляет кадр запроса и возвращает кадр ответа. При отмене ctx ожидание ответа
+	// прерывается и возвращается ошибка ctx
+	Fetch(ctx context.Context, request []byte) ([]byte, error)
+}
+
+// NewTransport создаёт канал связи со стендом по настройкам конфига
+type NewTransport func(Config) Transport
+
+var (
+	ErrTimeout = errors.New("нет ответа")
+	ErrClosed  = errors.New("соединение не установлено")
+)
+
+// ConfigTransport создаёт канал связи со стендом, выбранный в конфиге
+func ConfigTransport(cfg Config) Transport {
+	switch cfg.Link {
+	case LinkTCP, LinkRTUOverTCP:
+		return newNetTransport(cfg)
+	}
+	return newSerialTransport(cfg)
+}
+
+// serialTransport - COM порт. Ожидание ответа прерывается закрытием порта
+type serialTransport struct {
+	port   *comport.Port
+	mu     sync.Mutex
+	opened bool
+}
+
+type fetchResult struct {
+	response []byte
+	err      error
+}
+
+func newSerialTransport(cfg Config) Transport {
+	return &serialTransport{port: comport.NewPort(comport.Config{
+		Serial: serial.Config{
+			ReadTimeout: time.Millisecond,
+			Baud:        cfg.Comm.Baud,
+			Name:        cfg.SerialPortName,
+			Parity:      serial.Parity(cfg.Comm.Parity[0]),
+			StopBits:    serial.StopBits(cfg.Comm.StopBits),
+		},
+		Fetch: fetch.Config{
+			MaxAttemptsRead: cfg.Comm.MaxAttemptsRead,
+			ReadTimeout:     millis(cfg.Comm.ReadTimeout),
+			ReadByteTimeout: millis(cfg.Comm.ReadByteTimeout),
+		},
+	})}
+}
+
+func (x *serialTransport) Open() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.port.Open(); err != nil {
+		return err
+	}
+	x.opened = true
+	return nil
+}
+
+func (x *serialTransport) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.opened {
+		return nil
+	}
+	x.opened = false
+	return x.port.Close()
+}
+
+func (x *serialTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch := make(chan fetchResult, 1)
+	go func() {
+		response, err := x.port.Fetch(request)
+		ch <- fetchResult{response, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.response, r.err
+	case <-ctx.Done():
+		// закрытие порта прерывает чтение, результат Fetch уже не нужен
+		if err := x.Close(); err != nil {
+			fmt.Println("закрытие порта:", err)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// delayTransport выдерживает паузу перед каждым запросом
+type delayTransport struct {
+	Transport
+	delay time.Duration
+}
+
+func withRequestDelay(port Transport, delay time.Duration) Transport {
+	if delay <= 0 {
+		return port
+	}
+	return delayTransport{port, delay}
+}
+
+func (x delayTransport) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	if err := waitUntil(ctx, time.Now().Add(x.delay)); err != nil {
+		return nil, err
+	}
+	return x.Transport.Fetch(ctx, request)
+}
+
+// Loopback - канал связи, передающий запросы обработчику в памяти процесса.
+// Handler возвращает nil, если ответа нет
+type Loopback struct {
+	Handler func(request []byte) []byte
+	mu      sync.Mutex
+	opened  bool
+}
+
+func (x *Loopback) Open() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.opened = true
+	return nil
+}
+
+func (x *Loopback) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.opened = false
+	return nil
+}
+
+func (x *Loopback) Fetch(ctx context.Context, request []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	x.mu.Lock()
+	opened := x.opened
+	x.mu.Unlock()
+	if !opened {
+		return nil, ErrClosed
+	}
+	response := x.Handler(request)
+	if response == nil {
+		return nil, ErrTimeout
+	}
+	return response, nil
+}
+
+func connectionFailed(err error) bool {
+	return fetch.ConnectionFailed(err) || errors.Cause(err) == ErrClosed || netConnectionFailed(err)
+}
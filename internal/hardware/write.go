@@ -0,0 +1,85 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// RegisterWrite - запись регистров места стенда: команды установки нуля, сброса, смены диапазона.
+// Values записываются, начиная с регистра Register+Offset места Pin: одно значение - функцией 6,
+// несколько - функцией 16
+type RegisterWrite struct {
+	Pin    int
+	Offset uint16
+	Values []uint16
+	// Error - результат записи
+	Error error
+}
+
+// PlaceRegisters - количество регистров блока места, в пределах которого выполняется запись
+const PlaceRegisters = 6
+
+// maxPendingWrites - наибольшее количество запросов записи, ожидающих выполнения в сеансе опроса
+const maxPendingWrites = 16
+
+var errNotPolling = errors.New("запись невозможна: опрос не выполняется")
+
+// writePlace выполняет запись w в регистры места
+func writePlace(ctx context.Context, port Transport, places []Place, w RegisterWrite) error {
+	if w.Pin < 0 || w.Pin >= len(places) {
+		return fmt.Errorf("нет места %d", w.Pin+1)
+	}
+	if len(w.Values) == 0 {
+		return errors.New("нет значений для записи")
+	}
+	if int(w.Offset)+len(w.Values) > PlaceRegisters {
+		return fmt.Errorf("запись %d регистров со смещения %d выходит за блок регистров места", len(w.Values), w.Offset)
+	}
+	p := places[w.Pin]
+	ctx = withPins(ctx, w.Pin)
+	if len(w.Values) == 1 {
+		return WriteRegister(ctx, port, p.Addr, p.Register+w.Offset, w.Values[0])
+	}
+	return WriteRegisters(ctx, port, p.Addr, p.Register+w.Offset, w.Values)
+}
+
+// waitCycle ожидает наступления момента t, выполняя поступающие запросы записи.
+// Возвращает ошибку связи при записи или ошибку ctx
+func (x Provider) waitCycle(ctx context.Context, port Transport, places []Place, t time.Time, writes <-chan RegisterWrite) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	for {
+		// запись выполняется раньше начала цикла, даже если его время уже наступило
+		select {
+		case w := <-writes:
+			if err := x.write(ctx, port, places, w); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+		select {
+		case w := <-writes:
+			if err := x.write(ctx, port, places, w); err != nil {
+				return err
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (x Provider) write(ctx context.Context, port Transport, places []Place, w RegisterWrite) error {
+	x.peer.HardwareCurrentPlace(w.Pin)
+	w.Error = writePlace(ctx, port, places, w)
+	x.peer.HardwareCurrentPlace(-1)
+	x.peer.HardwareWrite(w)
+	if connectionFailed(w.Error) {
+		return w.Error
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,29 @@
+package hardware
+
+import (
+	"context"
+	"github.com/fpawel/ufo82/internal/hardware/simulator"
+	"testing"
+)
+
+func TestWritePlaceValidate(t *testing.T) {
+	port := &Loopback{Handler: simulator.New().Handle}
+	port.Open()
+	places := defaultConfig().Places
+	for _, c := range []struct {
+		w  RegisterWrite
+		ok bool
+	}{
+		{RegisterWrite{Pin: 1, Offset: 4, Values: []uint16{1, 2}}, true},
+		{RegisterWrite{Pin: 1, Offset: 0, Values: make([]uint16, 6)}, true},
+		{RegisterWrite{Pin: 1, Offset: 0}, false},
+		{RegisterWrite{Pin: 1, Offset: 5, Values: []uint16{1, 2}}, false},
+		{RegisterWrite{Pin: 1, Offset: 0xFFFF, Values: []uint16{1}}, false},
+		{RegisterWrite{Pin: 1, Values: make([]uint16, 124)}, false},
+		{RegisterWrite{Pin: 10, Values: []uint16{1}}, false},
+	} {
+		if err := writePlace(context.Background(), port, places, c.w); (err == nil) != c.ok {
+			t.Errorf("%d %d %d: %v", c.w.Pin, c.w.Offset, len(c.w.Values), err)
+		}
+	}
+}
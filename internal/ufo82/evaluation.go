@@ -0,0 +1,81 @@
+package ufo82
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EvaluationSamples - количество чувствительностей прибора, среднее которых - итоговое значение
+// прибора: первых после установления показания или, если показание не установилось, последних
+const EvaluationSamples = 10
+
+// Limits - допустимые пределы итогового значения чувствительности прибора
+type Limits struct {
+	Min float64 `db:"min_value"`
+	Max float64 `db:"max_value"`
+}
+
+// ProductResult - итог проверки прибора: итоговое значение, годен ли прибор и причина брака
+type ProductResult struct {
+	ProductID ProductID `db:"product_id"`
+	// Value не задано, если у прибора нет измерений
+	Value  sql.NullFloat64 `db:"value"`
+	Passed bool            `db:"passed"`
+	Reason string          `db:"reason"`
+	// Limits - пределы, с которыми сравнивалось итоговое значение
+	Limits
+	EvaluatedAt time.Time `db:"evaluated_at"`
+}
+
+func (x Limits) Validate() error {
+	if x.Min > x.Max {
+		return fmt.Errorf("нижний предел чувствительности %v больше верхнего %v", x.Min, x.Max)
+	}
+	return nil
+}
+
+// EvaluateProduct вычисляет итоговое значение прибора по его чувствительностям и сравнивает
+// его с пределами limits. stabilizedAt - момент установления показания прибора, нулевое время,
+// если показание не установилось
+func EvaluateProduct(productID ProductID, xs []Sensitivity, limits Limits, stabilizedAt time.Time) ProductResult {
+	r := ProductResult{ProductID: productID, Limits: limits, EvaluatedAt: time.Now()}
+	if len(xs) == 0 {
+		r.Reason = "нет измерений"
+		return r
+	}
+	xs = append([]Sensitivity(nil), xs...)
+	sort.Slice(xs, func(i, j int) bool {
+		return xs[i].StoredAt.Before(xs[j].StoredAt)
+	})
+	if !stabilizedAt.IsZero() {
+		n := sort.Search(len(xs), func(i int) bool {
+			return !xs[i].StoredAt.Before(stabilizedAt)
+		})
+		if n < len(xs) {
+			xs = xs[n:]
+			if len(xs) > EvaluationSamples {
+				xs = xs[:EvaluationSamples]
+			}
+		}
+	}
+	if len(xs) > EvaluationSamples {
+		xs = xs[len(xs)-EvaluationSamples:]
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x.Value
+	}
+	v := sum / float64(len(xs))
+	r.Value = sql.NullFloat64{Float64: v, Valid: true}
+	switch {
+	case v < limits.Min:
+		r.Reason = fmt.Sprintf("чувствительность %v ниже нормы %v", v, limits.Min)
+	case v > limits.Max:
+		r.Reason = fmt.Sprintf("чувствительность %v выше нормы %v", v, limits.Max)
+	default:
+		r.Passed = true
+	}
+	return r
+}
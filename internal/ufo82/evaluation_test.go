@@ -0,0 +1,53 @@
+package ufo82
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluateProduct(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sec := func(n int) time.Time {
+		return t0.Add(time.Duration(n) * time.Second)
+	}
+	// 30 чувствительностей в обратном порядке: значение равно секунде измерения
+	var xs []Sensitivity
+	for i := 29; i >= 0; i-- {
+		xs = append(xs, Sensitivity{StoredAt: sec(i), Value: float64(i)})
+	}
+	limits := Limits{Min: 0, Max: 100}
+
+	for _, c := range []struct {
+		name         string
+		xs           []Sensitivity
+		limits       Limits
+		stabilizedAt time.Time
+		valid        bool
+		value        float64
+		passed       bool
+		reason       string
+	}{
+		{name: "нет измерений", limits: limits, reason: "нет измерений"},
+		// показание не установилось - среднее последних 20..29
+		{name: "последние", xs: xs, limits: limits, valid: true, value: 24.5, passed: true},
+		// первые 5..14 после установления
+		{name: "после установления", xs: xs, limits: limits, stabilizedAt: sec(5), valid: true, value: 9.5, passed: true},
+		// после установления измерений нет - последние
+		{name: "установление после измерений", xs: xs, limits: limits, stabilizedAt: sec(100), valid: true, value: 24.5, passed: true},
+		{name: "ниже нормы", xs: xs, limits: Limits{Min: 30, Max: 40}, valid: true, value: 24.5,
+			reason: "чувствительность 24.5 ниже нормы 30"},
+		{name: "выше нормы", xs: xs, limits: Limits{Min: 0, Max: 10}, valid: true, value: 24.5,
+			reason: "чувствительность 24.5 выше нормы 10"},
+	} {
+		r := EvaluateProduct(1, c.xs, c.limits, c.stabilizedAt)
+		if r.Value.Valid != c.valid || r.Value.Float64 != c.value || r.Passed != c.passed || r.Reason != c.reason {
+			t.Errorf("%s: %+v", c.name, r)
+		}
+		if r.ProductID != 1 || r.Limits != c.limits {
+			t.Errorf("%s: %+v", c.name, r)
+		}
+	}
+	if xs[0].StoredAt != sec(29) {
+		t.Error("входные чувствительности изменены")
+	}
+}
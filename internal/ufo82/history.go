@@ -0,0 +1,82 @@
+package ufo82
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MaxProductHistory - наибольшее количество записей истории приборов в ответе на запрос
+const MaxProductHistory = 1000
+
+// ProductHistory - прибор одной из партий, в которой был его заводской номер, со сводкой
+// чувствительностей и итогом проверки
+type ProductHistory struct {
+	Product
+	PartyCreatedAt time.Time `db:"party_created_at"`
+	// SensitivitiesCount - количество чувствительностей. Если их нет, Min, Max и Mean
+	// не заданы, FirstStoredAt и LastStoredAt нулевые
+	SensitivitiesCount int             `db:"sensitivities_count"`
+	Min                sql.NullFloat64 `db:"min_value"`
+	Max                sql.NullFloat64 `db:"max_value"`
+	Mean               sql.NullFloat64 `db:"mean_value"`
+	FirstStoredAt      time.Time
+	LastStoredAt       time.Time
+	// Evaluated - прибор проверен, Passed, ResultValue и Reason - итог проверки
+	Evaluated   bool            `db:"evaluated"`
+	Passed      bool            `db:"passed"`
+	ResultValue sql.NullFloat64 `db:"result_value"`
+	Reason      string          `db:"reason"`
+}
+
+// GetProductHistory возвращает приборы с заводскими номерами от serialMin до serialMax во всех
+// партиях по порядку номеров и дат партий, не больше MaxProductHistory первых. total - количество
+// всех приборов диапазона: если оно больше len(xs), список неполный
+func (x DB) GetProductHistory(ctx context.Context, serialMin, serialMax int64) (xs []ProductHistory, total int, err error) {
+	if serialMin < 1 || serialMin > serialMax {
+		return nil, 0, fmt.Errorf("недопустимый диапазон заводских номеров: %d - %d", serialMin, serialMax)
+	}
+	err = x.Conn.GetContext(ctx, &total, `
+SELECT count(*) FROM products WHERE product_number BETWEEN $1 AND $2;`, serialMin, serialMax)
+	if err != nil {
+		return nil, 0, err
+	}
+	var rows []struct {
+		ProductHistory
+		FirstDay sql.NullFloat64 `db:"first_day"`
+		LastDay  sql.NullFloat64 `db:"last_day"`
+	}
+	err = x.Conn.SelectContext(ctx, &rows, `
+SELECT products.*,
+       parties.created_at AS party_created_at,
+       count(sensitivities.value) AS sensitivities_count,
+       min(sensitivities.value) AS min_value,
+       max(sensitivities.value) AS max_value,
+       avg(sensitivities.value) AS mean_value,
+       min(julianday(sensitivities.stored_at)) AS first_day,
+       max(julianday(sensitivities.stored_at)) AS last_day,
+       product_results.product_id IS NOT NULL AS evaluated,
+       ifnull(product_results.passed, 0) AS passed,
+       product_results.value AS result_value,
+       ifnull(product_results.reason, '') AS reason
+FROM products
+  INNER JOIN parties ON parties.party_id = products.party_id
+  LEFT JOIN sensitivities ON sensitivities.product_id = products.product_id
+  LEFT JOIN product_results ON product_results.product_id = products.product_id
+WHERE products.product_number BETWEEN $1 AND $2
+GROUP BY products.product_id
+ORDER BY products.product_number, parties.created_at
+LIMIT $3;`, serialMin, serialMax, MaxProductHistory)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, r := range rows {
+		if r.FirstDay.Valid {
+			r.FirstStoredAt = julianDayTime(r.FirstDay.Float64)
+			r.LastStoredAt = julianDayTime(r.LastDay.Float64)
+		}
+		xs = append(xs, r.ProductHistory)
+	}
+	return
+}
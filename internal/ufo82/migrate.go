@@ -0,0 +1,161 @@
+package ufo82
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+)
+
+// migration - шаг изменения схемы базы данных
+type migration struct {
+	name string
+	sql  string
+}
+
+// migrations - шаги изменения схемы по порядку. Номер шага, считая с единицы, сохраняется в
+// PRAGMA user_version после его выполнения. Выполненные шаги не меняются, новые добавляются в конец
+var migrations = []migration{
+	{"исходная схема", createDBSQL},
+	{"калибровки", migrationCalibrationsSQL},
+	{"пределы чувствительности", migrationSensitivityLimitsSQL},
+	{"установление показаний", migrationStabilizationsSQL},
+	{"результаты проверки", migrationProductResultsSQL},
+	{"индекс чувствительностей", migrationSensitivitiesIndexSQL},
+	{"индекс заводских номеров", migrationProductNumberIndexSQL},
+	{"сведения о партии", migrationPartyInfoSQL},
+	{"ключ чувствительностей", migrationSensitivitiesKeySQL},
+}
+
+// migrate выполняет шаги изменения схемы, следующие за user_version. Каждый шаг выполняется
+// в отдельной транзакции вместе с изменением user_version
+func migrate(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, `PRAGMA user_version;`); err != nil {
+		return err
+	}
+	if version == 0 {
+		// база данных, созданная до введения версий, уже содержит исходную схему
+		var n int
+		err := db.Get(&n, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'parties';`)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			version = 1
+		}
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("версия базы данных %d новее версии программы %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		if err := migrateStep(db, version+1, m); err != nil {
+			return fmt.Errorf("миграция базы данных %d %q: %v", version+1, m.name, err)
+		}
+		fmt.Println("база данных: миграция", version+1, m.name)
+	}
+	return nil
+}
+
+func migrateStep(db *sqlx.DB, version int, m migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(m.sql); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const migrationCalibrationsSQL = `
+CREATE TABLE calibrations (
+  product_id INTEGER PRIMARY KEY,
+  zero_value REAL NOT NULL,
+  span_value REAL NOT NULL,
+  span_concentration REAL NOT NULL,
+  offset_coef REAL NOT NULL,
+  gain_coef REAL NOT NULL,
+  calibrated_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+  FOREIGN KEY(product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+`
+
+const migrationSensitivityLimitsSQL = `
+CREATE TABLE sensitivity_limits (
+  limits_id INTEGER PRIMARY KEY CHECK (limits_id = 1),
+  min_value REAL NOT NULL,
+  max_value REAL NOT NULL,
+  CONSTRAINT limits_order CHECK (min_value <= max_value)
+);
+
+INSERT OR IGNORE INTO sensitivity_limits (limits_id, min_value, max_value) VALUES (1, 0, 1000);
+`
+
+const migrationStabilizationsSQL = `
+CREATE TABLE stabilizations (
+  product_id INTEGER PRIMARY KEY,
+  stabilized_at TIMESTAMP NOT NULL,
+  value REAL NOT NULL,
+  FOREIGN KEY(product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+`
+
+const migrationProductResultsSQL = `
+CREATE TABLE product_results (
+  product_id INTEGER PRIMARY KEY,
+  value REAL,
+  passed INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  min_value REAL NOT NULL,
+  max_value REAL NOT NULL,
+  evaluated_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+  FOREIGN KEY(product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+`
+
+const migrationSensitivitiesIndexSQL = `
+CREATE INDEX sensitivities_product_stored_at ON sensitivities (product_id, stored_at);
+`
+
+const migrationProductNumberIndexSQL = `
+CREATE INDEX products_product_number ON products (product_number);
+`
+
+const migrationPartyInfoSQL = `
+ALTER TABLE parties ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE parties ADD COLUMN operator TEXT NOT NULL DEFAULT '';
+ALTER TABLE parties ADD COLUMN product_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE parties ADD COLUMN batch_number TEXT NOT NULL DEFAULT '';
+ALTER TABLE parties ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+ALTER TABLE parties ADD COLUMN temperature REAL;
+ALTER TABLE parties ADD COLUMN humidity REAL;
+ALTER TABLE parties ADD COLUMN pressure REAL;
+`
+
+// Время чувствительностей хранится в формате драйвера sqlite3 в UTC: такие строки упорядочены
+// так же, как время, и сравниваются с параметрами запроса без преобразования, по индексу.
+// current_timestamp предыдущих версий дополняется смещением UTC
+const migrationSensitivitiesKeySQL = `
+CREATE TABLE sensitivities_keyed (
+  id INTEGER PRIMARY KEY,
+  product_id INTEGER NOT NULL,
+  stored_at TIMESTAMP NOT NULL,
+  value REAL NOT NULL,
+  FOREIGN KEY(product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+
+INSERT INTO sensitivities_keyed (id, product_id, stored_at, value)
+SELECT rowid, product_id,
+       CASE WHEN length(stored_at) = 19 THEN stored_at || '+00:00' ELSE stored_at END,
+       value
+FROM sensitivities;
+
+DROP TABLE sensitivities;
+ALTER TABLE sensitivities_keyed RENAME TO sensitivities;
+CREATE INDEX sensitivities_product_stored_at ON sensitivities (product_id, stored_at);
+`
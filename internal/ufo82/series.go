@@ -0,0 +1,167 @@
+package ufo82
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MaxSensitivityBuckets - наибольшее количество интервалов ряда чувствительностей
+const MaxSensitivityBuckets = 10000
+
+// SensitivityBucket - чувствительности прибора за интервал времени от StartsAt: количество,
+// наименьшее, наибольшее и среднее значения
+type SensitivityBucket struct {
+	StartsAt time.Time
+	Count    int     `db:"count"`
+	Min      float64 `db:"min_value"`
+	Max      float64 `db:"max_value"`
+	Mean     float64 `db:"mean_value"`
+}
+
+// GetSensitivityBuckets делит диапазон времени [from, to] на count равных интервалов и
+// возвращает непустые интервалы по порядку. Нулевые from или to заменяются временем первой
+// или последней чувствительности прибора. Интервалы считаются в UTC
+func (x DB) GetSensitivityBuckets(ctx context.Context, productID ProductID, from, to time.Time, count int) (buckets []SensitivityBucket, err error) {
+	if count < 1 || count > MaxSensitivityBuckets {
+		return nil, fmt.Errorf("количество интервалов должно быть от 1 до %d: %d", MaxSensitivityBuckets, count)
+	}
+	if from.IsZero() || to.IsZero() {
+		var first, last time.Time
+		err = x.Conn.GetContext(ctx, &first, `
+SELECT stored_at FROM sensitivities WHERE product_id = $1 ORDER BY stored_at LIMIT 1;`, productID)
+		if err == nil {
+			err = x.Conn.GetContext(ctx, &last, `
+SELECT stored_at FROM sensitivities WHERE product_id = $1 ORDER BY stored_at DESC LIMIT 1;`, productID)
+		}
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if from.IsZero() {
+			from = first
+		}
+		if to.IsZero() {
+			to = last
+		}
+	}
+	from, to = from.UTC(), to.UTC()
+	if to.Before(from) {
+		return nil, fmt.Errorf("начало диапазона %v позже конца %v", from, to)
+	}
+	// ширина интервала в сутках, как julianday
+	width := to.Sub(from).Hours() / 24 / float64(count)
+	if width == 0 {
+		width = 1
+	}
+	// sqlite нумерует параметры $N по порядку их первого появления в тексте запроса,
+	// поэтому все они перечислены в начале, в params. Время сравнивается в формате хранения,
+	// чтобы использовать индекс (product_id, stored_at)
+	var xs []struct {
+		Bucket int `db:"bucket"`
+		SensitivityBucket
+	}
+	err = x.Conn.SelectContext(ctx, &xs, `
+WITH params AS (
+  SELECT $1 AS product_id, $2 AS from_at, $3 AS to_at, julianday($2) AS from_day, $4 AS width, $5 AS last_bucket
+)
+SELECT min(cast((julianday(s.stored_at) - p.from_day) / p.width AS INTEGER), p.last_bucket) AS bucket,
+       count(*) AS count,
+       min(s.value) AS min_value,
+       max(s.value) AS max_value,
+       avg(s.value) AS mean_value
+FROM sensitivities s, params p
+WHERE s.product_id = $1 AND s.stored_at BETWEEN $2 AND $3
+GROUP BY bucket
+ORDER BY bucket;`, productID, from, to, width, count-1)
+	if err != nil {
+		return nil, err
+	}
+	step := to.Sub(from) / time.Duration(count)
+	for _, b := range xs {
+		b.StartsAt = from.Add(time.Duration(b.Bucket) * step)
+		buckets = append(buckets, b.SensitivityBucket)
+	}
+	return
+}
+
+// julianDayTime переводит юлианский день SQLite во время
+func julianDayTime(day float64) time.Time {
+	const unixEpochJulianDay = 2440587.5
+	return time.Unix(0, int64((day-unixEpochJulianDay)*24*float64(time.Hour))).UTC()
+}
+
+// MaxSensitivitiesPage - наибольшее количество чувствительностей на странице
+const MaxSensitivitiesPage = 10000
+
+// SensitivitiesQuery - запрос страницы чувствительностей прибора в диапазоне времени
+// [From, To], нулевые From или To не ограничивают диапазон. Чувствительности упорядочены по
+// порядку сохранения, он же порядок измерения. Cursor - курсор, после которого начинается
+// страница, 0 - с начала. Backward - от новых к старым
+type SensitivitiesQuery struct {
+	ProductID ProductID
+	From, To  time.Time
+	Cursor    int64
+	Limit     int
+	Backward  bool
+}
+
+// SensitivitiesPage - страница чувствительностей. Next - курсор для запроса следующей страницы,
+// 0, если страница последняя
+type SensitivitiesPage struct {
+	Sensitivities []Sensitivity
+	Next          int64
+}
+
+// GetSensitivitiesPage возвращает страницу чувствительностей прибора
+func (x DB) GetSensitivitiesPage(ctx context.Context, q SensitivitiesQuery) (page SensitivitiesPage, err error) {
+	if q.Limit < 1 || q.Limit > MaxSensitivitiesPage {
+		return page, fmt.Errorf("размер страницы должен быть от 1 до %d: %d", MaxSensitivitiesPage, q.Limit)
+	}
+	// курсор - id чувствительности
+	cmp, order := ">", "ASC"
+	if q.Backward {
+		cmp, order = "<", "DESC"
+	}
+	// условия добавляются только для заданных параметров, чтобы запрос использовал индекс
+	// (product_id, stored_at). Время сравнивается в формате хранения
+	where := "product_id = $1"
+	args := []interface{}{q.ProductID}
+	param := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if q.Cursor != 0 {
+		param("id "+cmp+" $%d", q.Cursor)
+	}
+	if !q.From.IsZero() {
+		param("stored_at >= $%d", q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		param("stored_at <= $%d", q.To.UTC())
+	}
+	var xs []struct {
+		ID int64 `db:"id"`
+		Sensitivity
+	}
+	// запрашивается на одну больше, чтобы узнать, есть ли следующая страница
+	err = x.Conn.SelectContext(ctx, &xs, fmt.Sprintf(`
+SELECT id, stored_at, value FROM sensitivities
+WHERE %s
+ORDER BY id %s
+LIMIT %d;`, where, order, q.Limit+1), args...)
+	if err != nil {
+		return
+	}
+	if len(xs) > q.Limit {
+		xs = xs[:q.Limit]
+		page.Next = xs[len(xs)-1].ID
+	}
+	for _, s := range xs {
+		page.Sensitivities = append(page.Sensitivities, s.Sensitivity)
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package ufo82
 
 import (
+	"database/sql"
 	"time"
 )
 
@@ -10,6 +11,22 @@ type ProductID int64
 type Party struct {
 	PartyID   PartyID   `db:"party_id"`
 	CreatedAt time.Time `db:"created_at"`
+	PartyInfo
+}
+
+// PartyInfo - сведения о партии, задаваемые оператором
+type PartyInfo struct {
+	Name        string `db:"name"`
+	Operator    string `db:"operator"`
+	ProductType string `db:"product_type"`
+	// BatchNumber - номер заказа или производственной партии
+	BatchNumber string `db:"batch_number"`
+	Notes       string `db:"notes"`
+	// условия окружающей среды: температура, °C, влажность, %, давление, кПа. Не заданы,
+	// если не измерялись
+	Temperature sql.NullFloat64 `db:"temperature"`
+	Humidity    sql.NullFloat64 `db:"humidity"`
+	Pressure    sql.NullFloat64 `db:"pressure"`
 }
 
 type Product struct {
@@ -24,6 +41,25 @@ type Sensitivity struct {
 	Value    float64   `db:"value"`
 }
 
+// ProductSensitivity - чувствительность прибора для сохранения
+type ProductSensitivity struct {
+	ProductID ProductID
+	StoredAt  time.Time
+	Value     float32
+}
+
+// Calibration - калибровка прибора по нулевому газу и газу с концентрацией SpanConcentration.
+// Показание прибора пересчитывается как Gain*показание + Offset
+type Calibration struct {
+	ProductID         ProductID `db:"product_id"`
+	ZeroValue         float64   `db:"zero_value"`
+	SpanValue         float64   `db:"span_value"`
+	SpanConcentration float64   `db:"span_concentration"`
+	Offset            float64   `db:"offset_coef"`
+	Gain              float64   `db:"gain_coef"`
+	CalibratedAt      time.Time `db:"calibrated_at"`
+}
+
 type YearMonth struct {
 	Year, Month int
 }
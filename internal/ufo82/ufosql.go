@@ -1,8 +1,10 @@
 package ufo82
 
 import (
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"time"
 )
 
 type DB struct {
@@ -13,71 +15,71 @@ func (x DB) Close() error {
 	return x.Conn.Close()
 }
 
-func MustConnectDB(filename string) (x DB) {
-
-	var createdNewFile bool
-	x.Conn = sqlx.MustConnect("sqlite3", filename)
-	x.Conn.MustExec(intiDBSQL)
-	if createdNewFile {
-		x.Conn.MustExec(createDBSQL)
+// ConnectDB открывает файл базы данных, создавая его при отсутствии, и приводит схему
+// к текущей версии
+func ConnectDB(filename string) (x DB, err error) {
+	// PRAGMA в строке подключения выполняются для каждого нового соединения.
+	// Журнал WAL: при synchronous = NORMAL fsync выполняется только при переносе журнала в базу
+	x.Conn, err = sqlx.Connect("sqlite3", filename+"?_foreign_keys=1&_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		return
+	}
+	// соединение одно: запросы нескольких горутин выполняются по очереди, чтение ожидает окончания записи
+	x.Conn.SetMaxOpenConns(1)
+	err = migrate(x.Conn)
+	if err != nil {
+		x.Conn.Close()
 	}
 	return
 }
 
-func (x DB) GetLastPartyID() (r PartyID) {
-	err := x.Conn.Get(&r, `SELECT party_id FROM parties ORDER BY created_at DESC LIMIT 1;`)
+func MustConnectDB(filename string) DB {
+	x, err := ConnectDB(filename)
 	if err != nil {
 		panic(err)
 	}
+	return x
+}
+
+func (x DB) GetLastPartyID(ctx context.Context) (r PartyID, err error) {
+	err = x.Conn.GetContext(ctx, &r, `SELECT party_id FROM parties ORDER BY created_at DESC LIMIT 1;`)
 	return
 }
 
-func (x DB) GetLastPartyProducts() (products []Product) {
-	err := x.Conn.Select(&products, `
+func (x DB) GetLastPartyProducts(ctx context.Context) (products []Product, err error) {
+	err = x.Conn.SelectContext(ctx, &products, `
 SELECT * FROM products 
 WHERE party_id = ( SELECT party_id FROM parties ORDER BY created_at DESC LIMIT 1) 
 ORDER BY order_in_party ASC;`)
-	if err != nil {
-		panic(err)
-	}
 	return
 }
 
-func (x DB) GetYears() (xs []int) {
-	err := x.Conn.Select(&xs, `
+func (x DB) GetYears(ctx context.Context) (xs []int, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
 SELECT cast(strftime('%Y', created_at) AS INT) AS year FROM parties GROUP BY year;`)
-	if err != nil {
-		panic(err)
-	}
 	return
 }
 
-func (x DB) GetDaysOfYearMonth(ym YearMonth) (xs []int64) {
-	err := x.Conn.Select(&xs, `
+func (x DB) GetDaysOfYearMonth(ctx context.Context, ym YearMonth) (xs []int64, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
 SELECT cast( strftime('%d', created_at) AS INT) AS day FROM parties
 WHERE  cast(strftime('%Y', created_at) AS INT) = $1 AND cast(strftime('%m', created_at) AS INT) = $2
 GROUP BY day;
 `, ym.Year, ym.Month)
-	if err != nil {
-		panic(err)
-	}
 	return
 }
 
-func (x DB) GetMonthsOfYear(year int) (xs []int) {
-	err := x.Conn.Select(&xs, `
+func (x DB) GetMonthsOfYear(ctx context.Context, year int) (xs []int, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
 SELECT cast( strftime('%m', created_at) AS INT) AS month FROM parties
 WHERE cast(strftime('%Y', created_at) AS INT) = $1
 GROUP BY month;
 `, year)
-	if err != nil {
-		panic(err)
-	}
 	return
 }
 
-func (x DB) GetPartiesOfYearMonthDay(ym YearMonthDay) (xs []Party) {
-	err := x.Conn.Select(&xs, `
+func (x DB) GetPartiesOfYearMonthDay(ctx context.Context, ym YearMonthDay) (xs []Party, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
 SELECT * FROM parties
 WHERE
   cast(strftime('%Y', created_at) AS INT) = $1 AND
@@ -85,101 +87,273 @@ WHERE
   cast(strftime('%d', created_at) AS INT) = $3
 ORDER BY created_at;
 `, ym.Year, ym.Month, ym.Day)
-	if err != nil {
-		panic(err)
-	}
 	return
 }
 
-func (x DB) GetPartyByID(partyID PartyID) (party Party, products []Product) {
-	err := x.Conn.Get(&party, `SELECT * FROM parties WHERE party_id = $1;`, partyID)
-	if err != nil {
-		panic(err)
-	}
-	err = x.Conn.Select(&products, `SELECT * FROM products WHERE party_id = $1 ORDER BY order_in_party ASC;`, partyID)
+func (x DB) GetPartyByID(ctx context.Context, partyID PartyID) (party Party, products []Product, err error) {
+	err = x.Conn.GetContext(ctx, &party, `SELECT * FROM parties WHERE party_id = $1;`, partyID)
 	if err != nil {
-		panic(err)
+		return
 	}
+	err = x.Conn.SelectContext(ctx, &products, `SELECT * FROM products WHERE party_id = $1 ORDER BY order_in_party ASC;`, partyID)
 	return
 }
 
-func (x DB) GetSensitivitiesByProductID(productID ProductID) (xs []Sensitivity) {
-	err := x.Conn.Select(&xs, `
+func (x DB) GetSensitivitiesByProductID(ctx context.Context, productID ProductID) (xs []Sensitivity, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
 SELECT stored_at,value FROM sensitivities
 WHERE product_id = $1
 GROUP BY stored_at;
 `, productID)
+	return
+}
+
+// AddSensitivities сохраняет чувствительности приборов в одной транзакции. Чувствительности
+// удалённых к этому времени приборов пропускаются
+func (x DB) AddSensitivities(ctx context.Context, xs []ProductSensitivity) error {
+	tx, err := x.Conn.BeginTxx(ctx, nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	stmt, err := tx.PreparexContext(ctx, `
+INSERT INTO sensitivities (product_id, stored_at, value) 
+SELECT $1, $2, $3 WHERE exists(SELECT product_id FROM products WHERE product_id = $1);`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, s := range xs {
+		if _, err := stmt.ExecContext(ctx, s.ProductID, s.StoredAt.UTC(), s.Value); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+func (x DB) ClearProductSensitivities(ctx context.Context, productID ProductID) error {
+	_, err := x.Conn.ExecContext(ctx, `DELETE FROM sensitivities WHERE product_id = $1;`, productID)
+	return err
+}
+
+// SaveCalibration сохраняет калибровку прибора, заменяя предыдущую
+func (x DB) SaveCalibration(ctx context.Context, c Calibration) error {
+	_, err := x.Conn.ExecContext(ctx, `
+INSERT OR REPLACE INTO calibrations
+  (product_id, zero_value, span_value, span_concentration, offset_coef, gain_coef, calibrated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		c.ProductID, c.ZeroValue, c.SpanValue, c.SpanConcentration, c.Offset, c.Gain, c.CalibratedAt.UTC())
+	return err
+}
+
+// GetPartyCalibrations возвращает калибровки откалиброванных приборов партии
+func (x DB) GetPartyCalibrations(ctx context.Context, partyID PartyID) (xs []Calibration, err error) {
+	err = x.Conn.SelectContext(ctx, &xs, `
+SELECT calibrations.* FROM calibrations
+  INNER JOIN products ON calibrations.product_id = products.product_id
+WHERE products.party_id = $1;`, partyID)
 	return
 }
 
-func (x DB) AddNewSensitivity(productID ProductID, sensitivity float32) {
-	_, err := x.Conn.Exec(`
-INSERT INTO sensitivities (product_id, value) 
-VALUES ($1,$2);`, productID, sensitivity)
+// SetProductStabilization сохраняет момент установления показания прибора. Сохраняется первый
+// момент сеанса: повторное установление после ошибки опроса его не меняет, момент
+// сбрасывается ClearProductStabilization при новом подключении
+func (x DB) SetProductStabilization(ctx context.Context, productID ProductID, stabilizedAt time.Time, value float32) error {
+	_, err := x.Conn.ExecContext(ctx, `
+INSERT OR IGNORE INTO stabilizations (product_id, stabilized_at, value) 
+VALUES ($1, $2, $3);`, productID, stabilizedAt.UTC(), value)
+	return err
+}
+
+// GetProductStabilization возвращает момент установления показания прибора, нулевое время,
+// если показание не установилось
+func (x DB) GetProductStabilization(ctx context.Context, productID ProductID) (time.Time, error) {
+	var xs []time.Time
+	err := x.Conn.SelectContext(ctx, &xs, `SELECT stabilized_at FROM stabilizations WHERE product_id = $1;`, productID)
+	if err != nil || len(xs) == 0 {
+		return time.Time{}, err
+	}
+	return xs[0], nil
+}
+
+func (x DB) ClearProductStabilization(ctx context.Context, productID ProductID) error {
+	_, err := x.Conn.ExecContext(ctx, `DELETE FROM stabilizations WHERE product_id = $1;`, productID)
+	return err
+}
+
+// ClearProductResult удаляет итог проверки прибора, устаревший после нового измерения
+func (x DB) ClearProductResult(ctx context.Context, productID ProductID) error {
+	_, err := x.Conn.ExecContext(ctx, `DELETE FROM product_results WHERE product_id = $1;`, productID)
+	return err
+}
+
+func (x DB) GetSensitivityLimits(ctx context.Context) (r Limits, err error) {
+	err = x.Conn.GetContext(ctx, &r, `SELECT min_value, max_value FROM sensitivity_limits WHERE limits_id = 1;`)
+	return
+}
+
+func (x DB) SetSensitivityLimits(ctx context.Context, limits Limits) error {
+	_, err := x.Conn.ExecContext(ctx, `
+UPDATE sensitivity_limits SET min_value = $1, max_value = $2 WHERE limits_id = 1;`, limits.Min, limits.Max)
+	return err
+}
+
+// EvaluateParty проверяет приборы партии по текущим пределам чувствительности и сохраняет итоги
+// в одной транзакции
+func (x DB) EvaluateParty(ctx context.Context, partyID PartyID) (results []ProductResult, err error) {
+	limits, err := x.GetSensitivityLimits(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	_, products, err := x.GetPartyByID(ctx, partyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range products {
+		stabilizedAt, err := x.GetProductStabilization(ctx, p.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		xs, err := x.GetSensitivitiesByProductID(ctx, p.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, EvaluateProduct(p.ProductID, xs, limits, stabilizedAt))
+	}
+	tx, err := x.Conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		_, err := tx.ExecContext(ctx, `
+INSERT OR REPLACE INTO product_results
+  (product_id, value, passed, reason, min_value, max_value, evaluated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+			r.ProductID, r.Value, r.Passed, r.Reason, r.Min, r.Max, r.EvaluatedAt.UTC())
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return
 }
 
-func (x DB) ClearProductSensitivities(productID ProductID) {
-	_, err := x.Conn.Exec(`DELETE FROM sensitivities WHERE product_id = $1;`, productID)
+// GetPartyResults возвращает итоги проверки приборов партии по их идентификаторам
+func (x DB) GetPartyResults(ctx context.Context, partyID PartyID) (map[ProductID]ProductResult, error) {
+	var xs []ProductResult
+	err := x.Conn.SelectContext(ctx, &xs, `
+SELECT product_results.* FROM product_results
+  INNER JOIN products ON product_results.product_id = products.product_id
+WHERE products.party_id = $1;`, partyID)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	m := make(map[ProductID]ProductResult)
+	for _, r := range xs {
+		m[r.ProductID] = r
 	}
+	return m, nil
 }
 
-func (x DB) ApplyCurrentProductSerial(inp ProductOrderSerial) string {
-	partyID := x.GetLastPartyID()
-	_, products := x.GetPartyByID(partyID)
+func (x DB) ApplyCurrentProductSerial(ctx context.Context, inp ProductOrderSerial) (string, error) {
+	partyID, err := x.GetLastPartyID(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, products, err := x.GetPartyByID(ctx, partyID)
+	if err != nil {
+		return "", err
+	}
 	strProduct := fmt.Sprintf("продукт №%d, заводской номер %d", inp.Order+1, inp.Serial)
 
 	for _, p := range products {
 		if p.ProductNumber == int64(inp.Serial) {
 			if p.Order == int64(inp.Order) {
-				return strProduct
+				return strProduct, nil
 			}
-			return fmt.Sprintf("%s: дублирование заводского номера", strProduct)
+			return fmt.Sprintf("%s: дублирование заводского номера", strProduct), nil
 		}
 	}
 
 	for _, p := range products {
 		if p.Order == int64(inp.Order) {
 			if inp.Serial <= 0 {
-				if _, err := x.Conn.Exec(`DELETE FROM products WHERE product_id = $1`, p.ProductID); err != nil {
-					panic(err)
+				if _, err := x.Conn.ExecContext(ctx, `DELETE FROM products WHERE product_id = $1`, p.ProductID); err != nil {
+					return "", err
 				}
-				return fmt.Sprintf("Удалён продукт №%d", inp.Order+1)
+				return fmt.Sprintf("Удалён продукт №%d", inp.Order+1), nil
 			} else {
-				if _, err := x.Conn.Exec(`UPDATE products SET product_number = $1 WHERE product_id = $2`,
+				if _, err := x.Conn.ExecContext(ctx, `UPDATE products SET product_number = $1 WHERE product_id = $2`,
 					inp.Serial, p.ProductID); err != nil {
-					panic(err)
+					return "", err
 				}
-				return fmt.Sprintf("Изменён %s", strProduct)
+				if err := x.ClearProductResult(ctx, p.ProductID); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Изменён %s", strProduct), nil
 			}
 
 		}
 	}
-	_, err := x.Conn.Exec(`
+	_, err = x.Conn.ExecContext(ctx, `
 INSERT INTO products (party_id, product_number, order_in_party)  
 VALUES ($1, $2, $3);`, partyID, inp.Serial, inp.Order)
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+	return fmt.Sprintf("Добавлен в текущую партию %s", strProduct), nil
+}
+
+// SetPartyInfo сохраняет сведения о партии
+func (x DB) SetPartyInfo(ctx context.Context, partyID PartyID, info PartyInfo) error {
+	r, err := x.Conn.ExecContext(ctx, `
+UPDATE parties 
+SET name = $1, operator = $2, product_type = $3, batch_number = $4, notes = $5, 
+    temperature = $6, humidity = $7, pressure = $8
+WHERE party_id = $9;`,
+		info.Name, info.Operator, info.ProductType, info.BatchNumber, info.Notes,
+		info.Temperature, info.Humidity, info.Pressure, partyID)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("партия %d не найдена", partyID)
+	}
+	return err
+}
+
+// CreateNewParty удаляет партии без измерений и без сведений, кроме оператора и типа приборов,
+// и приборы последней партии без измерений, затем создаёт новую партию с приборами, оператором и
+// типом приборов последней партии. Изменения выполняются в одной транзакции
+func (x DB) CreateNewParty(ctx context.Context) error {
+	tx, err := x.Conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := createNewParty(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
 	}
-	return fmt.Sprintf("Добавлен в текущую партию %s", strProduct)
+	return tx.Commit()
 }
 
-func (x DB) CreateNewParty() {
+func createNewParty(ctx context.Context, tx *sqlx.Tx) error {
 
-	_, err := x.Conn.Exec(`
+	_, err := tx.ExecContext(ctx, `
 DELETE FROM parties
 WHERE NOT exists
 ( SELECT sensitivities.product_id
   FROM sensitivities
     INNER JOIN products on sensitivities.product_id = products.product_id
-  WHERE products.party_id = parties.party_id);
+  WHERE products.party_id = parties.party_id) AND
+  name = '' AND batch_number = '' AND notes = '' AND
+  temperature IS NULL AND humidity IS NULL AND pressure IS NULL;
 DELETE FROM products
 WHERE
   party_id=(SELECT parties.party_id FROM parties ORDER BY created_at DESC LIMIT 1) AND
@@ -189,46 +363,54 @@ WHERE
       WHERE sensitivities.product_id = products.product_id)
   );`)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if len(x.GetYears()) == 0 {
-		_, err := x.Conn.Exec(`
+	var partiesCount int
+	if err := tx.GetContext(ctx, &partiesCount, `SELECT count(*) FROM parties;`); err != nil {
+		return err
+	}
+	if partiesCount == 0 {
+		_, err := tx.ExecContext(ctx, `
 INSERT INTO parties DEFAULT VALUES;
 INSERT INTO products (party_id, product_number, order_in_party)  VALUES (last_insert_rowid(), 1, 0);`)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
-	_, products := x.GetPartyByID(x.GetLastPartyID())
+	var products []Product
+	err = tx.SelectContext(ctx, &products, `
+SELECT * FROM products 
+WHERE party_id = ( SELECT party_id FROM parties ORDER BY created_at DESC LIMIT 1) 
+ORDER BY order_in_party ASC;`)
+	if err != nil {
+		return err
+	}
 
-	r, err := x.Conn.Exec(`INSERT INTO parties DEFAULT VALUES; SELECT last_insert_rowid()`)
+	r, err := tx.ExecContext(ctx, `
+INSERT INTO parties (operator, product_type)
+SELECT operator, product_type FROM parties ORDER BY created_at DESC LIMIT 1;`)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	v, err := r.LastInsertId()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	newPartyID := PartyID(v)
 	for _, p := range products {
-		_, err := x.Conn.Exec(`
+		_, err := tx.ExecContext(ctx, `
 INSERT INTO products (party_id, product_number, order_in_party)  
 VALUES ($1, $2, $3);`, newPartyID, p.ProductNumber, p.Order)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
-	return
+	return nil
 }
 
-const intiDBSQL = `
-PRAGMA foreign_keys = ON;
-PRAGMA encoding = 'UTF-8';
-`
-
 const createDBSQL = `
 CREATE TABLE parties (
   party_id        INTEGER PRIMARY KEY,
@@ -1,152 +1,397 @@
 package ufo82
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
-	"log"
-	"math"
-	"math/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-func (x DB) addNewParty(t time.Time) PartyID {
-	r, err := x.Conn.Exec(`INSERT INTO parties (created_at) VALUES ($1);SELECT last_insert_rowid();`, t)
+// tempDBFilename возвращает имя файла базы данных во временной папке и функцию удаления папки
+func tempDBFilename(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ufo82")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "products.db"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func tempDB(t *testing.T) (DB, func()) {
+	filename, remove := tempDBFilename(t)
+	db, err := ConnectDB(filename)
+	if err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		remove()
+	}
+}
+
+func (x DB) addNewParty(t *testing.T, createdAt time.Time) PartyID {
+	r, err := x.Conn.Exec(`INSERT INTO parties (created_at) VALUES ($1);`, createdAt.UTC())
+	if err != nil {
+		t.Fatal(err)
 	}
 	partyID, err := r.LastInsertId()
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	return PartyID(partyID)
 }
 
-func (x DB) addNewProduct(partyID PartyID, order, serial int64) ProductID {
+func (x DB) addNewProduct(t *testing.T, partyID PartyID, order, serial int64) ProductID {
 	r, err := x.Conn.Exec(`
-INSERT INTO products (party_id, order_in_party, ProductNumber) 
-VALUES ($1, $2, $3);
-SELECT last_insert_rowid();`, partyID, order, serial)
+INSERT INTO products (party_id, order_in_party, product_number) VALUES ($1, $2, $3);`,
+		partyID, order, serial)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	productID, err := r.LastInsertId()
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	return ProductID(productID)
 }
 
-func TestFolderPath(t *testing.T) {
-	fmt.Println(ProductName.Path())
+func userVersion(t *testing.T, db *sqlx.DB) (version int) {
+	if err := db.Get(&version, `PRAGMA user_version;`); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMigrateNewFile(t *testing.T) {
+	filename, remove := tempDBFilename(t)
+	defer remove()
+	for i := 0; i < 2; i++ {
+		// повторное подключение не выполняет миграции заново
+		db, err := ConnectDB(filename)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if v := userVersion(t, db.Conn); v != len(migrations) {
+			t.Errorf("%d: версия %d, ожидалась %d", i, v, len(migrations))
+		}
+		if limits, err := db.GetSensitivityLimits(context.Background()); err != nil || limits != (Limits{0, 1000}) {
+			t.Errorf("%d: %+v, %v", i, limits, err)
+		}
+		var journalMode string
+		var foreignKeys, synchronous int
+		err = db.Conn.Get(&journalMode, `PRAGMA journal_mode;`)
+		if err == nil {
+			err = db.Conn.Get(&foreignKeys, `PRAGMA foreign_keys;`)
+		}
+		if err == nil {
+			err = db.Conn.Get(&synchronous, `PRAGMA synchronous;`)
+		}
+		// synchronous = NORMAL - 1
+		if err != nil || journalMode != "wal" || foreignKeys != 1 || synchronous != 1 {
+			t.Errorf("%d: PRAGMA %q %d %d, %v", i, journalMode, foreignKeys, synchronous, err)
+		}
+		db.Close()
+	}
 }
 
-func TestCreateTestDB(t *testing.T) {
-	fmt.Println(ProductName.Path())
-	db := MustConnectDB("products.db")
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+func TestMigratePreVersioningFile(t *testing.T) {
+	filename, remove := tempDBFilename(t)
+	defer remove()
 
-	tm := func(y, m, d int) time.Time {
-		return time.Date(y, time.Month(m), d, 8, 0, 0, 0, time.Local)
+	// база данных версии программы без учёта версий схемы
+	conn, err := sqlx.Connect("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(createDBSQL + `
+INSERT INTO sensitivities (product_id, value) VALUES (1, 42);`)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, t := range []time.Time{
-		tm(2015, 2, 2),
-		tm(2015, 2, 3),
-		tm(2015, 2, 4),
+	db, err := ConnectDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if v := userVersion(t, db.Conn); v != len(migrations) {
+		t.Errorf("версия %d, ожидалась %d", v, len(migrations))
+	}
+	party, products, err := db.GetPartyByID(ctx, 1)
+	if err != nil || len(products) != 1 || party.PartyInfo != (PartyInfo{}) {
+		t.Fatalf("%+v, %+v, %v", party, products, err)
+	}
+	xs, err := db.GetSensitivitiesByProductID(ctx, products[0].ProductID)
+	if err != nil || len(xs) != 1 || xs[0].Value != 42 {
+		t.Fatalf("%+v, %v", xs, err)
+	}
 
-		tm(2016, 3, 8),
-		tm(2016, 3, 9),
-		tm(2016, 3, 10),
-		tm(2016, 3, 11),
+	// время current_timestamp приведено к формату хранения и сравнивается с параметрами запроса
+	var storedAt string
+	if err := db.Conn.Get(&storedAt, `SELECT cast(stored_at AS TEXT) FROM sensitivities;`); err != nil {
+		t.Fatal(err)
+	}
+	if len(storedAt) != 25 || storedAt[19:] != "+00:00" {
+		t.Errorf("stored_at %q", storedAt)
+	}
+	page, err := db.GetSensitivitiesPage(ctx, SensitivitiesQuery{
+		ProductID: products[0].ProductID, From: xs[0].StoredAt, To: xs[0].StoredAt, Limit: 1})
+	if err != nil || len(page.Sensitivities) != 1 || page.Next != 0 {
+		t.Fatalf("%+v, %v", page, err)
+	}
+	page, err = db.GetSensitivitiesPage(ctx, SensitivitiesQuery{
+		ProductID: products[0].ProductID, From: xs[0].StoredAt.Add(time.Millisecond), Limit: 1})
+	if err != nil || len(page.Sensitivities) != 0 {
+		t.Fatalf("%+v, %v", page, err)
+	}
+}
+
+func TestSensitivitiesSeries(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	ctx := context.Background()
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sec := func(n float64) time.Time {
+		return t0.Add(time.Duration(n * float64(time.Second)))
+	}
+	productID := db.addNewProduct(t, db.addNewParty(t, t0), 0, 100)
 
-		tm(2017, 7, 11),
-		tm(2017, 7, 12),
-		tm(2017, 7, 13),
-		tm(2017, 7, 14),
-		tm(2017, 7, 15),
-		tm(2017, 7, 16),
+	var ps []ProductSensitivity
+	for n := 0; n < 10; n++ {
+		ps = append(ps, ProductSensitivity{ProductID: productID, StoredAt: sec(float64(n)), Value: float32(n)})
+	}
+	if err := db.AddSensitivities(ctx, ps); err != nil {
+		t.Fatal(err)
+	}
+
+	type bucket struct {
+		count int
+		mean  float64
+	}
+	for _, c := range []struct {
+		from, to time.Time
+		count    int
+		want     []bucket
+	}{
+		{count: 1, want: []bucket{{10, 4.5}}},
+		{count: 2, want: []bucket{{5, 2}, {5, 7}}},
+		{from: sec(2), to: sec(6.5), count: 1, want: []bucket{{5, 4}}},
+		{from: sec(1.5), to: sec(7.5), count: 3, want: []bucket{{2, 2.5}, {2, 4.5}, {2, 6.5}}},
 	} {
-		partyID := db.addNewParty(t)
-		for n := int64(0); n < 10; n++ {
-			productID := db.addNewProduct(partyID, n, int64(partyID)+n)
-			var xs []Sensitivity
-			f1 := newFunc(rnd)
-			f2 := newFunc(rnd)
-			for nPt := int64(0); nPt < 1000; nPt++ {
-				x := float64(nPt)
-				xs = append(xs, Sensitivity{
-					StoredAt: t.Add(time.Second * time.Duration(nPt)),
-					Value:    f1(x) - f2(x),
-				})
+		xs, err := db.GetSensitivityBuckets(ctx, productID, c.from, c.to, c.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []bucket
+		for _, x := range xs {
+			got = append(got, bucket{x.Count, x.Mean})
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%v - %v, %d: %+v", c.from, c.to, c.count, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%v - %v, %d: %+v", c.from, c.to, c.count, got)
 			}
-			db.addSensitivities(productID, xs)
 		}
 	}
 
-	if err := db.Conn.Close(); err != nil {
-		panic(err)
+	pages := func(q SensitivitiesQuery) (r [][]float64) {
+		for {
+			page, err := db.GetSensitivitiesPage(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var xs []float64
+			for _, s := range page.Sensitivities {
+				if !s.StoredAt.Equal(sec(s.Value)) {
+					t.Errorf("%v: %v", s.Value, s.StoredAt)
+				}
+				xs = append(xs, s.Value)
+			}
+			r = append(r, xs)
+			if page.Next == 0 {
+				return
+			}
+			q.Cursor = page.Next
+		}
+	}
+	for _, c := range []struct {
+		q    SensitivitiesQuery
+		want [][]float64
+	}{
+		{SensitivitiesQuery{From: sec(1), To: sec(8), Limit: 4},
+			[][]float64{{1, 2, 3, 4}, {5, 6, 7, 8}}},
+		{SensitivitiesQuery{Limit: 4, Backward: true},
+			[][]float64{{9, 8, 7, 6}, {5, 4, 3, 2}, {1, 0}}},
+		{SensitivitiesQuery{From: sec(3.5), Limit: 10},
+			[][]float64{{4, 5, 6, 7, 8, 9}}},
+	} {
+		c.q.ProductID = productID
+		got := pages(c.q)
+		if len(got) != len(c.want) {
+			t.Errorf("%+v: %v", c.q, got)
+			continue
+		}
+		for i := range got {
+			if len(got[i]) != len(c.want[i]) {
+				t.Errorf("%+v: %v", c.q, got)
+				break
+			}
+			for j := range got[i] {
+				if got[i][j] != c.want[i][j] {
+					t.Errorf("%+v: %v", c.q, got)
+				}
+			}
+		}
 	}
 }
 
-func TestYears(t *testing.T) {
-	db := MustConnectDB("products.db")
-	fmt.Printf("%+v", db.GetYears())
-	if err := db.Conn.Close(); err != nil {
-		panic(err)
+func TestProductHistory(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	ctx := context.Background()
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	party1 := db.addNewParty(t, t0)
+	party2 := db.addNewParty(t, t0.AddDate(0, 1, 0))
+	p2 := db.addNewProduct(t, party2, 0, 100)
+	p1 := db.addNewProduct(t, party1, 0, 100)
+	p3 := db.addNewProduct(t, party1, 1, 101)
+	db.addNewProduct(t, party1, 2, 200)
+
+	err := db.AddSensitivities(ctx, []ProductSensitivity{
+		{ProductID: p1, StoredAt: t0.Add(time.Second), Value: 1},
+		{ProductID: p1, StoredAt: t0.Add(2 * time.Second), Value: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.EvaluateParty(ctx, party1); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestSensitivities(t *testing.T) {
-	db := MustConnectDB("products.db")
-	fmt.Printf("%+v", db.GetSensitivitiesByProductID(1))
-	if err := db.Conn.Close(); err != nil {
-		panic(err)
+	xs, total, err := db.GetProductHistory(ctx, 100, 150)
+	if err != nil || total != 3 {
+		t.Fatal(total, err)
+	}
+	if len(xs) != 3 || xs[0].ProductID != p1 || xs[1].ProductID != p2 || xs[2].ProductID != p3 {
+		t.Fatalf("%+v", xs)
+	}
+	x := xs[0]
+	if x.SensitivitiesCount != 2 || x.Min.Float64 != 1 || x.Max.Float64 != 3 || x.Mean.Float64 != 2 ||
+		!x.PartyCreatedAt.Equal(t0) ||
+		x.FirstStoredAt.Sub(t0.Add(time.Second)).Round(time.Millisecond) != 0 ||
+		x.LastStoredAt.Sub(t0.Add(2*time.Second)).Round(time.Millisecond) != 0 ||
+		!x.Evaluated || !x.Passed || x.ResultValue.Float64 != 2 {
+		t.Errorf("%+v", x)
+	}
+	x = xs[1]
+	if x.SensitivitiesCount != 0 || x.Mean.Valid || !x.FirstStoredAt.IsZero() || x.Evaluated {
+		t.Errorf("%+v", x)
+	}
+	x = xs[2]
+	if x.SensitivitiesCount != 0 || !x.Evaluated || x.Passed || x.Reason != "нет измерений" {
+		t.Errorf("%+v", x)
 	}
-}
 
-func TestProducts(t *testing.T) {
-	db := MustConnectDB("products.db")
-	var xs []Product
-	err := db.Conn.Select(&xs, `SELECT * FROM products LIMIT 10;`)
+	// список ограничен MaxProductHistory, total - количество всех приборов диапазона
+	_, err = db.Conn.Exec(`
+WITH RECURSIVE n(i) AS (SELECT 0 UNION ALL SELECT i + 1 FROM n WHERE i < $1)
+INSERT INTO products (party_id, order_in_party, product_number) SELECT $2, i + 10, i + 1000 FROM n;`,
+		MaxProductHistory, party2)
 	if err != nil {
-		log.Panic(err)
+		t.Fatal(err)
+	}
+	xs, total, err = db.GetProductHistory(ctx, 1000, 10000)
+	if err != nil || len(xs) != MaxProductHistory || total != MaxProductHistory+1 {
+		t.Errorf("%d, %d, %v", len(xs), total, err)
 	}
 
-	fmt.Printf("%+v", xs)
-	if err := db.Conn.Close(); err != nil {
-		panic(err)
+	if _, _, err := db.GetProductHistory(ctx, 150, 100); err == nil {
+		t.Error("обратный диапазон: нет ошибки")
 	}
 }
 
-func (x *DB) addSensitivities(productID ProductID, sensitivities []Sensitivity) {
-	sql := "INSERT INTO sensitivities (product_id, stored_at, value) VALUES "
+func TestSetPartyInfo(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	ctx := context.Background()
 
-	for n, s := range sensitivities {
-		sql += fmt.Sprintf("(%d,'%s',%v)", productID,
-			s.StoredAt.UTC().Format(time.RFC3339), s.Value)
-		if n == len(sensitivities)-1 {
-			sql += ";"
-		} else {
-			sql += ", "
-		}
+	partyID, err := db.GetLastPartyID(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	t := time.Now()
-	_, err := x.Conn.Exec(sql)
-	fmt.Println("+", productID, time.Since(t))
+	info := PartyInfo{
+		Name:        "партия 1",
+		Operator:    "Иванов",
+		ProductType: "УФО-82",
+		BatchNumber: "З-17",
+		Notes:       "примечание",
+		Temperature: sql.NullFloat64{Float64: 21.5, Valid: true},
+		Pressure:    sql.NullFloat64{Float64: 101.3, Valid: true},
+	}
+	if err := db.SetPartyInfo(ctx, partyID, info); err != nil {
+		t.Fatal(err)
+	}
+	party, _, err := db.GetPartyByID(ctx, partyID)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if party.PartyInfo != info {
+		t.Errorf("%+v", party.PartyInfo)
+	}
+	if err := db.SetPartyInfo(ctx, partyID+1, info); err == nil {
+		t.Error("несуществующая партия: нет ошибки")
 	}
 }
 
-func newFunc(rnd *rand.Rand) func(float64) float64 {
+func TestCreateNewParty(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	ctx := context.Background()
 
-	return func(x float64) (r float64) {
-		for i := float64(0); i < 5; i++ {
-			r += rnd.Float64() * 10 * math.Sin(x*i)
+	partyID, err := db.GetLastPartyID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := PartyInfo{Name: "партия 1", Operator: "Иванов", ProductType: "УФО-82"}
+	if err := db.SetPartyInfo(ctx, partyID, info); err != nil {
+		t.Fatal(err)
+	}
+	parties := func() (xs []Party) {
+		if err := db.Conn.Select(&xs, `SELECT * FROM parties ORDER BY created_at, party_id;`); err != nil {
+			t.Fatal(err)
 		}
 		return
 	}
 
+	// партия без измерений, но с названием, сохраняется
+	if err := db.CreateNewParty(ctx); err != nil {
+		t.Fatal(err)
+	}
+	xs := parties()
+	if len(xs) != 2 || xs[0].PartyID != partyID || xs[0].PartyInfo != info ||
+		xs[1].PartyInfo != (PartyInfo{Operator: "Иванов", ProductType: "УФО-82"}) {
+		t.Fatalf("%+v", xs)
+	}
+
+	// новая партия с одними оператором и типом приборов удаляется, они переходят в следующую
+	if err := db.CreateNewParty(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ys := parties()
+	if len(ys) != 2 || ys[0] != xs[0] || ys[1].PartyInfo != xs[1].PartyInfo {
+		t.Fatalf("%+v", ys)
+	}
 }
@@ -0,0 +1,208 @@
+package ufo82
+
+import (
+	"context"
+	"fmt"
+	"github.com/fpawel/ufo82/internal/hardware"
+	"time"
+)
+
+const (
+	// writerFlushInterval - период записи накопленных чувствительностей в базу данных
+	writerFlushInterval = 500 * time.Millisecond
+	// writerFlushSize - количество накопленных чувствительностей, при котором они записываются
+	// не дожидаясь периода
+	writerFlushSize = 1000
+	// writerFlushAttempts - количество неудачных попыток записи подряд, после которого
+	// накопленные чувствительности отбрасываются
+	writerFlushAttempts = 20
+	// writerTimeout - наибольшее время выполнения запроса к базе данных
+	writerTimeout = 10 * time.Second
+)
+
+// Writer сохраняет в базу данных показания мест стенда, полученные по подписке на события
+// оборудования, как чувствительности приборов текущей партии. Чувствительности накапливаются и
+// записываются одной транзакцией раз в writerFlushInterval, а также при остановке опроса, изменении
+// партии, закрытии подписки и по запросу Flush. При ошибке записи чувствительности остаются
+// накопленными до следующей попытки
+type Writer struct {
+	db           DB
+	bus          *hardware.Bus
+	sub          *hardware.Subscription
+	interval     time.Duration
+	timeout      time.Duration
+	partyChanged chan struct{}
+	done         chan struct{}
+	pending      []ProductSensitivity
+	// failures - количество неудачных попыток записи pending подряд
+	failures int
+}
+
+// flushMarker - запрос Flush, передаваемый через очередь подписки после полученных до него событий
+type flushMarker struct{ done chan struct{} }
+
+func (x flushMarker) Dispatch(hardware.Peer) {}
+
+// NewWriter подписывается на события bus. База данных не должна терять показания,
+// поэтому очередь подписки без ограничения размера
+func NewWriter(db DB, bus *hardware.Bus) *Writer {
+	return newWriter(db, bus, writerFlushInterval, writerTimeout)
+}
+
+func newWriter(db DB, bus *hardware.Bus, interval, timeout time.Duration) *Writer {
+	x := &Writer{
+		db:           db,
+		bus:          bus,
+		sub:          bus.SubscribeUnbounded("db"),
+		interval:     interval,
+		timeout:      timeout,
+		partyChanged: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// PartyChanged сообщает об изменении состава текущей партии
+func (x *Writer) PartyChanged() {
+	select {
+	case x.partyChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Flush записывает чувствительности, накопленные и ожидающие в очереди подписки, и ожидает
+// окончания записи. Вызывается перед операциями над партией, которым нужны все полученные показания
+func (x *Writer) Flush() {
+	done := make(chan struct{})
+	// после отписки Writer завершается, записав накопленные чувствительности
+	x.bus.PublishTo(x.sub, flushMarker{done})
+	select {
+	case <-done:
+	case <-x.done:
+	}
+}
+
+// Wait ожидает завершения после закрытия подписки
+func (x *Writer) Wait() {
+	<-x.done
+}
+
+func (x *Writer) run() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.interval)
+	defer ticker.Stop()
+	currentProducts := x.lastPartyProducts()
+	for {
+		select {
+		case <-ticker.C:
+			x.flush()
+
+		case <-x.partyChanged:
+			x.flush()
+			currentProducts = x.lastPartyProducts()
+
+		case e, ok := <-x.sub.C:
+			if !ok {
+				x.flush()
+				return
+			}
+			ctx, cancel := x.context()
+			switch e := e.(type) {
+
+			case flushMarker:
+				x.flush()
+				close(e.done)
+
+			case hardware.EventConnected:
+				// новое подключение начинает измерение заново,
+				// при переподключении после потери связи данные сохраняются
+				x.flush()
+				x.discard()
+				currentProducts = x.lastPartyProducts()
+				for _, p := range currentProducts {
+					x.failed(x.db.ClearProductSensitivities(ctx, p.ProductID))
+					x.failed(x.db.ClearProductStabilization(ctx, p.ProductID))
+					x.failed(x.db.ClearProductResult(ctx, p.ProductID))
+				}
+
+			case hardware.EventDisconnected:
+				x.flush()
+
+			case hardware.EventReading:
+				if e.Error != nil {
+					break
+				}
+				for _, p := range currentProducts {
+					if p.Order == int64(e.Pin) {
+						x.pending = append(x.pending, ProductSensitivity{
+							ProductID: p.ProductID,
+							StoredAt:  e.Time,
+							Value:     e.Value,
+						})
+					}
+				}
+				// после неудачной записи следующая попытка - по таймеру
+				if len(x.pending) >= writerFlushSize && x.failures == 0 {
+					x.flush()
+				}
+
+			case hardware.EventStable:
+				for _, p := range currentProducts {
+					if p.Order == int64(e.Pin) {
+						x.failed(x.db.SetProductStabilization(ctx, p.ProductID, e.Time, e.Value))
+					}
+				}
+			}
+			cancel()
+		}
+	}
+}
+
+// flush записывает накопленные чувствительности. При ошибке они остаются накопленными, пока
+// количество неудачных попыток подряд не достигнет writerFlushAttempts
+func (x *Writer) flush() {
+	if len(x.pending) == 0 {
+		return
+	}
+	ctx, cancel := x.context()
+	defer cancel()
+	if err := x.db.AddSensitivities(ctx, x.pending); err != nil {
+		x.failures++
+		x.failed(fmt.Errorf("не сохранено чувствительностей %d, попытка %d: %v", len(x.pending), x.failures, err))
+		if x.failures >= writerFlushAttempts {
+			x.discard()
+		}
+		return
+	}
+	x.pending = x.pending[:0]
+	x.failures = 0
+}
+
+// discard отбрасывает чувствительности, которые не удалось записать
+func (x *Writer) discard() {
+	if len(x.pending) > 0 {
+		x.failed(fmt.Errorf("потеряно чувствительностей %d", len(x.pending)))
+	}
+	x.pending = x.pending[:0]
+	x.failures = 0
+}
+
+func (x *Writer) lastPartyProducts() []Product {
+	ctx, cancel := x.context()
+	defer cancel()
+	products, err := x.db.GetLastPartyProducts(ctx)
+	x.failed(err)
+	return products
+}
+
+func (x *Writer) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), x.timeout)
+}
+
+// failed выводит в консоль ошибку записи: показание теряется, запись следующих продолжается
+func (x *Writer) failed(err error) {
+	if err != nil {
+		fmt.Println("запись в базу данных:", err)
+	}
+}
@@ -0,0 +1,90 @@
+package ufo82
+
+import (
+	"context"
+	"errors"
+	"github.com/fpawel/ufo82/internal/hardware"
+	"testing"
+	"time"
+)
+
+// waitSensitivities ожидает записи n чувствительностей прибора
+func waitSensitivities(t *testing.T, db DB, productID ProductID, n int) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		xs, err := db.GetSensitivitiesByProductID(context.Background(), productID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(xs) == n {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("чувствительностей %d, ожидалось %d", len(xs), n)
+		}
+	}
+}
+
+func TestWriterBatch(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	partyID := db.addNewParty(t, time.Now().Add(time.Hour))
+	p0 := db.addNewProduct(t, partyID, 0, 100)
+	p1 := db.addNewProduct(t, partyID, 1, 101)
+
+	bus := hardware.NewBus()
+	// период больше времени теста: записывает только накопление writerFlushSize и Flush
+	w := newWriter(db, bus, time.Hour, time.Second)
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < writerFlushSize; i++ {
+		bus.HardwareReading(hardware.Reading{Pin: 0, Value: float32(i), Time: t0.Add(time.Duration(i) * time.Second)})
+	}
+	waitSensitivities(t, db, p0, writerFlushSize)
+
+	// Flush записывает показания, ожидающие в очереди подписки
+	bus.HardwareReading(hardware.Reading{Pin: 1, Value: 5, Time: t0})
+	bus.HardwareReading(hardware.Reading{Pin: 1, Value: 6, Time: t0, Error: errors.New("нет ответа")})
+	bus.HardwareReading(hardware.Reading{Pin: 7, Value: 7, Time: t0})
+	w.Flush()
+	xs, err := db.GetSensitivitiesByProductID(context.Background(), p1)
+	if err != nil || len(xs) != 1 || xs[0].Value != 5 {
+		t.Fatalf("%+v, %v", xs, err)
+	}
+
+	// закрытие подписки записывает накопленные показания
+	bus.HardwareReading(hardware.Reading{Pin: 1, Value: 8, Time: t0.Add(time.Second)})
+	bus.Close()
+	w.Wait()
+	waitSensitivities(t, db, p1, 2)
+	// после завершения Flush не ожидает
+	w.Flush()
+}
+
+func TestWriterRetry(t *testing.T) {
+	db, remove := tempDB(t)
+	defer remove()
+	p0 := db.addNewProduct(t, db.addNewParty(t, time.Now().Add(time.Hour)), 0, 100)
+
+	bus := hardware.NewBus()
+	defer bus.Close()
+	w := newWriter(db, bus, 20*time.Millisecond, 50*time.Millisecond)
+	// Flush без показаний ожидает, пока Writer считает приборы партии
+	w.Flush()
+
+	// единственное соединение с базой занято: запись не успевает получить его
+	ctx := context.Background()
+	conn, err := db.Conn.Connx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.HardwareReading(hardware.Reading{Pin: 0, Value: 1, Time: time.Now()})
+	w.Flush()
+	var n int
+	err = conn.GetContext(ctx, &n, `SELECT count(*) FROM sensitivities;`)
+	conn.Close()
+	if err != nil || n != 0 {
+		t.Fatalf("%d, %v", n, err)
+	}
+
+	// показание не потеряно и записывается следующей попыткой
+	waitSensitivities(t, db, p0, 1)
+}